@@ -0,0 +1,247 @@
+package command
+
+// defaultCommands is the redis 7 command set, used until the table is loaded from the server.
+// Fields: name, arity, flags, first key, last key, key step
+var defaultCommands = []Info{
+	{"acl", -2, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"append", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"asking", 1, Fast, 0, 0, 0},
+	{"auth", -2, NoScript | Loading | Stale | Fast | NoAuth, 0, 0, 0},
+	{"bgrewriteaof", 1, Admin | NoScript, 0, 0, 0},
+	{"bgsave", -1, Admin | NoScript, 0, 0, 0},
+	{"bitcount", -2, ReadOnly, 1, 1, 1},
+	{"bitfield", -2, Write | Denyoom, 1, 1, 1},
+	{"bitfield_ro", -2, ReadOnly | Fast, 1, 1, 1},
+	{"bitop", -4, Write | Denyoom, 2, -1, 1},
+	{"bitpos", -3, ReadOnly, 1, 1, 1},
+	{"blmove", 6, Write | Denyoom | NoScript | Blocking, 1, 2, 1},
+	{"blmpop", -5, Write | Blocking | MovableKeys, 0, 0, 0},
+	{"blpop", -3, Write | NoScript | Blocking, 1, -2, 1},
+	{"brpop", -3, Write | NoScript | Blocking, 1, -2, 1},
+	{"brpoplpush", 4, Write | Denyoom | NoScript | Blocking, 1, 2, 1},
+	{"bzmpop", -5, Write | Blocking | MovableKeys, 0, 0, 0},
+	{"bzpopmax", -3, Write | NoScript | Blocking | Fast, 1, -2, 1},
+	{"bzpopmin", -3, Write | NoScript | Blocking | Fast, 1, -2, 1},
+	{"client", -2, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"cluster", -2, Admin, 0, 0, 0},
+	{"command", -1, Random | Loading | Stale, 0, 0, 0},
+	{"config", -2, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"copy", -3, Write | Denyoom, 1, 2, 1},
+	{"dbsize", 1, ReadOnly | Fast, 0, 0, 0},
+	{"debug", -2, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"decr", 2, Write | Denyoom | Fast, 1, 1, 1},
+	{"decrby", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"del", -2, Write, 1, -1, 1},
+	{"discard", 1, NoScript | Loading | Stale | Fast, 0, 0, 0},
+	{"dump", 2, ReadOnly | Random, 1, 1, 1},
+	{"echo", 2, Fast, 0, 0, 0},
+	{"eval", -3, NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"eval_ro", -3, ReadOnly | NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"evalsha", -3, NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"evalsha_ro", -3, ReadOnly | NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"exec", 1, NoScript | Loading | Stale, 0, 0, 0},
+	{"exists", -2, ReadOnly | Fast, 1, -1, 1},
+	{"expire", -3, Write | Fast, 1, 1, 1},
+	{"expireat", -3, Write | Fast, 1, 1, 1},
+	{"expiretime", 2, ReadOnly | Fast, 1, 1, 1},
+	{"failover", -1, Admin | NoScript | Stale, 0, 0, 0},
+	{"fcall", -3, NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"fcall_ro", -3, ReadOnly | NoScript | SkipMonitor | MovableKeys, 0, 0, 0},
+	{"flushall", -1, Write, 0, 0, 0},
+	{"flushdb", -1, Write, 0, 0, 0},
+	{"function", -2, Write | NoScript, 0, 0, 0},
+	{"geoadd", -5, Write | Denyoom, 1, 1, 1},
+	{"geodist", -4, ReadOnly, 1, 1, 1},
+	{"geohash", -2, ReadOnly, 1, 1, 1},
+	{"geopos", -2, ReadOnly, 1, 1, 1},
+	{"georadius", -6, Write | Denyoom | MovableKeys, 1, 1, 1},
+	{"georadius_ro", -6, ReadOnly, 1, 1, 1},
+	{"georadiusbymember", -5, Write | Denyoom | MovableKeys, 1, 1, 1},
+	{"georadiusbymember_ro", -5, ReadOnly, 1, 1, 1},
+	{"geosearch", -7, ReadOnly, 1, 1, 1},
+	{"geosearchstore", -8, Write | Denyoom, 1, 2, 1},
+	{"get", 2, ReadOnly | Fast, 1, 1, 1},
+	{"getbit", 3, ReadOnly | Fast, 1, 1, 1},
+	{"getdel", 2, Write | Fast, 1, 1, 1},
+	{"getex", -2, Write | Fast, 1, 1, 1},
+	{"getrange", 4, ReadOnly, 1, 1, 1},
+	{"getset", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"hdel", -3, Write | Fast, 1, 1, 1},
+	{"hello", -1, NoScript | Loading | Stale | Fast | NoAuth, 0, 0, 0},
+	{"hexists", 3, ReadOnly | Fast, 1, 1, 1},
+	{"hget", 3, ReadOnly | Fast, 1, 1, 1},
+	{"hgetall", 2, ReadOnly, 1, 1, 1},
+	{"hincrby", 4, Write | Denyoom | Fast, 1, 1, 1},
+	{"hincrbyfloat", 4, Write | Denyoom | Fast, 1, 1, 1},
+	{"hkeys", 2, ReadOnly, 1, 1, 1},
+	{"hlen", 2, ReadOnly | Fast, 1, 1, 1},
+	{"hmget", -3, ReadOnly | Fast, 1, 1, 1},
+	{"hmset", -4, Write | Denyoom | Fast, 1, 1, 1},
+	{"hrandfield", -2, ReadOnly | Random, 1, 1, 1},
+	{"hscan", -3, ReadOnly | Random, 1, 1, 1},
+	{"hset", -4, Write | Denyoom | Fast, 1, 1, 1},
+	{"hsetnx", 4, Write | Denyoom | Fast, 1, 1, 1},
+	{"hstrlen", 3, ReadOnly | Fast, 1, 1, 1},
+	{"hvals", 2, ReadOnly, 1, 1, 1},
+	{"incr", 2, Write | Denyoom | Fast, 1, 1, 1},
+	{"incrby", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"incrbyfloat", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"info", -1, Random | Loading | Stale, 0, 0, 0},
+	{"keys", 2, ReadOnly, 0, 0, 0},
+	{"lastsave", 1, Random | Loading | Stale | Fast, 0, 0, 0},
+	{"latency", -2, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"lcs", -3, ReadOnly, 1, 2, 1},
+	{"lindex", 3, ReadOnly, 1, 1, 1},
+	{"linsert", 5, Write | Denyoom, 1, 1, 1},
+	{"llen", 2, ReadOnly | Fast, 1, 1, 1},
+	{"lmove", 5, Write | Denyoom, 1, 2, 1},
+	{"lmpop", -4, Write | MovableKeys, 0, 0, 0},
+	{"lolwut", -1, ReadOnly | Fast, 0, 0, 0},
+	{"lpop", -2, Write | Fast, 1, 1, 1},
+	{"lpos", -3, ReadOnly, 1, 1, 1},
+	{"lpush", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"lpushx", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"lrange", 4, ReadOnly, 1, 1, 1},
+	{"lrem", 4, Write, 1, 1, 1},
+	{"lset", 4, Write | Denyoom, 1, 1, 1},
+	{"ltrim", 4, Write, 1, 1, 1},
+	{"memory", -2, Random, 0, 0, 0},
+	{"mget", -2, ReadOnly | Fast, 1, -1, 1},
+	{"migrate", -6, Write | Random | MovableKeys, 3, 3, 1},
+	{"module", -2, Admin | NoScript, 0, 0, 0},
+	{"monitor", 1, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"move", 3, Write | Fast, 1, 1, 1},
+	{"mset", -3, Write | Denyoom, 1, -1, 2},
+	{"msetnx", -3, Write | Denyoom, 1, -1, 2},
+	{"multi", 1, NoScript | Loading | Stale | Fast, 0, 0, 0},
+	{"object", -2, ReadOnly | Random, 2, 2, 1},
+	{"persist", 2, Write | Fast, 1, 1, 1},
+	{"pexpire", -3, Write | Fast, 1, 1, 1},
+	{"pexpireat", -3, Write | Fast, 1, 1, 1},
+	{"pexpiretime", 2, ReadOnly | Fast, 1, 1, 1},
+	{"pfadd", -2, Write | Denyoom | Fast, 1, 1, 1},
+	{"pfcount", -2, ReadOnly, 1, -1, 1},
+	{"pfdebug", 3, Write | Denyoom | Admin, 2, 2, 1},
+	{"pfmerge", -2, Write | Denyoom, 1, -1, 1},
+	{"pfselftest", 1, Admin, 0, 0, 0},
+	{"ping", -1, Fast, 0, 0, 0},
+	{"psetex", 4, Write | Denyoom, 1, 1, 1},
+	{"psubscribe", -2, PubSub | NoScript | Loading | Stale, 0, 0, 0},
+	{"psync", -3, Admin | NoScript, 0, 0, 0},
+	{"pttl", 2, ReadOnly | Random | Fast, 1, 1, 1},
+	{"publish", 3, PubSub | Loading | Stale | Fast, 0, 0, 0},
+	{"pubsub", -2, PubSub | Random | Loading | Stale, 0, 0, 0},
+	{"punsubscribe", -1, PubSub | NoScript | Loading | Stale, 0, 0, 0},
+	{"quit", -1, NoScript | Loading | Stale | Fast | NoAuth, 0, 0, 0},
+	{"randomkey", 1, ReadOnly | Random, 0, 0, 0},
+	{"readonly", 1, Loading | Stale | Fast, 0, 0, 0},
+	{"readwrite", 1, Loading | Stale | Fast, 0, 0, 0},
+	{"rename", 3, Write, 1, 2, 1},
+	{"renamenx", 3, Write | Fast, 1, 2, 1},
+	{"replconf", -1, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"replicaof", 3, Admin | NoScript | Stale, 0, 0, 0},
+	{"reset", 1, NoScript | Loading | Stale | Fast | NoAuth, 0, 0, 0},
+	{"restore", -4, Write | Denyoom, 1, 1, 1},
+	{"restore-asking", -4, Write | Denyoom, 1, 1, 1},
+	{"role", 1, NoScript | Loading | Stale | Fast, 0, 0, 0},
+	{"rpop", -2, Write | Fast, 1, 1, 1},
+	{"rpoplpush", 3, Write | Denyoom, 1, 2, 1},
+	{"rpush", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"rpushx", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"sadd", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"save", 1, Admin | NoScript, 0, 0, 0},
+	{"scan", -2, ReadOnly | Random, 0, 0, 0},
+	{"scard", 2, ReadOnly | Fast, 1, 1, 1},
+	{"script", -2, NoScript, 0, 0, 0},
+	{"sdiff", -2, ReadOnly, 1, -1, 1},
+	{"sdiffstore", -3, Write | Denyoom, 1, -1, 1},
+	{"select", 2, Loading | Stale | Fast, 0, 0, 0},
+	{"set", -3, Write | Denyoom, 1, 1, 1},
+	{"setbit", 4, Write | Denyoom, 1, 1, 1},
+	{"setex", 4, Write | Denyoom, 1, 1, 1},
+	{"setnx", 3, Write | Denyoom | Fast, 1, 1, 1},
+	{"setrange", 4, Write | Denyoom, 1, 1, 1},
+	{"shutdown", -1, Admin | NoScript | Loading | Stale, 0, 0, 0},
+	{"sinter", -2, ReadOnly, 1, -1, 1},
+	{"sintercard", -3, ReadOnly | MovableKeys, 0, 0, 0},
+	{"sinterstore", -3, Write | Denyoom, 1, -1, 1},
+	{"sismember", 3, ReadOnly | Fast, 1, 1, 1},
+	{"slaveof", 3, Admin | NoScript | Stale, 0, 0, 0},
+	{"slowlog", -2, Admin | Random | Loading | Stale, 0, 0, 0},
+	{"smembers", 2, ReadOnly, 1, 1, 1},
+	{"smismember", -3, ReadOnly | Fast, 1, 1, 1},
+	{"smove", 4, Write | Fast, 1, 2, 1},
+	{"sort", -2, Write | Denyoom | MovableKeys, 1, 1, 1},
+	{"sort_ro", -2, ReadOnly | MovableKeys, 1, 1, 1},
+	{"spop", -2, Write | Random | Fast, 1, 1, 1},
+	{"spublish", 3, PubSub | Loading | Stale | Fast, 1, 1, 1},
+	{"srandmember", -2, ReadOnly | Random, 1, 1, 1},
+	{"srem", -3, Write | Fast, 1, 1, 1},
+	{"sscan", -3, ReadOnly | Random, 1, 1, 1},
+	{"ssubscribe", -2, PubSub | NoScript | Loading | Stale, 1, -1, 1},
+	{"strlen", 2, ReadOnly | Fast, 1, 1, 1},
+	{"subscribe", -2, PubSub | NoScript | Loading | Stale, 0, 0, 0},
+	{"substr", 4, ReadOnly, 1, 1, 1},
+	{"sunion", -2, ReadOnly, 1, -1, 1},
+	{"sunionstore", -3, Write | Denyoom, 1, -1, 1},
+	{"sunsubscribe", -1, PubSub | NoScript | Loading | Stale, 1, -1, 1},
+	{"swapdb", 3, Write | Fast, 0, 0, 0},
+	{"sync", 1, Admin | NoScript, 0, 0, 0},
+	{"time", 1, Random | Loading | Stale | Fast, 0, 0, 0},
+	{"touch", -2, ReadOnly | Fast, 1, -1, 1},
+	{"ttl", 2, ReadOnly | Random | Fast, 1, 1, 1},
+	{"type", 2, ReadOnly | Fast, 1, 1, 1},
+	{"unlink", -2, Write | Fast, 1, -1, 1},
+	{"unsubscribe", -1, PubSub | NoScript | Loading | Stale, 0, 0, 0},
+	{"unwatch", 1, NoScript | Loading | Stale | Fast, 0, 0, 0},
+	{"wait", 3, NoScript, 0, 0, 0},
+	{"waitaof", 4, NoScript, 0, 0, 0},
+	{"watch", -2, NoScript | Loading | Stale | Fast, 1, -1, 1},
+	{"xack", -4, Write | Fast, 1, 1, 1},
+	{"xadd", -5, Write | Denyoom | Fast, 1, 1, 1},
+	{"xautoclaim", -6, Write | Fast, 1, 1, 1},
+	{"xclaim", -6, Write | Fast, 1, 1, 1},
+	{"xdel", -3, Write | Fast, 1, 1, 1},
+	{"xgroup", -2, Write, 0, 0, 0},
+	{"xinfo", -2, ReadOnly | Random, 0, 0, 0},
+	{"xlen", 2, ReadOnly | Fast, 1, 1, 1},
+	{"xpending", -3, ReadOnly, 1, 1, 1},
+	{"xrange", -4, ReadOnly, 1, 1, 1},
+	{"xread", -4, ReadOnly | Blocking | MovableKeys, 0, 0, 0},
+	{"xreadgroup", -7, Write | Blocking | MovableKeys, 0, 0, 0},
+	{"xrevrange", -4, ReadOnly, 1, 1, 1},
+	{"xsetid", -3, Write | Denyoom | Fast, 1, 1, 1},
+	{"xtrim", -4, Write, 1, 1, 1},
+	{"zadd", -4, Write | Denyoom | Fast, 1, 1, 1},
+	{"zcard", 2, ReadOnly | Fast, 1, 1, 1},
+	{"zcount", 4, ReadOnly | Fast, 1, 1, 1},
+	{"zdiff", -3, ReadOnly | MovableKeys, 0, 0, 0},
+	{"zdiffstore", -4, Write | Denyoom | MovableKeys, 1, 1, 1},
+	{"zincrby", 4, Write | Denyoom | Fast, 1, 1, 1},
+	{"zinter", -3, ReadOnly | MovableKeys, 0, 0, 0},
+	{"zintercard", -3, ReadOnly | MovableKeys, 0, 0, 0},
+	{"zinterstore", -4, Write | Denyoom | MovableKeys, 1, 1, 1},
+	{"zlexcount", 4, ReadOnly | Fast, 1, 1, 1},
+	{"zmpop", -4, Write | MovableKeys, 0, 0, 0},
+	{"zmscore", -3, ReadOnly | Fast, 1, 1, 1},
+	{"zpopmax", -2, Write | Fast, 1, 1, 1},
+	{"zpopmin", -2, Write | Fast, 1, 1, 1},
+	{"zrandmember", -2, ReadOnly | Random, 1, 1, 1},
+	{"zrange", -4, ReadOnly, 1, 1, 1},
+	{"zrangebylex", -4, ReadOnly, 1, 1, 1},
+	{"zrangebyscore", -4, ReadOnly, 1, 1, 1},
+	{"zrangestore", -5, Write | Denyoom, 1, 2, 1},
+	{"zrank", -3, ReadOnly | Fast, 1, 1, 1},
+	{"zrem", -3, Write | Fast, 1, 1, 1},
+	{"zremrangebylex", 4, Write, 1, 1, 1},
+	{"zremrangebyrank", 4, Write, 1, 1, 1},
+	{"zremrangebyscore", 4, Write, 1, 1, 1},
+	{"zrevrange", -4, ReadOnly, 1, 1, 1},
+	{"zrevrangebylex", -4, ReadOnly, 1, 1, 1},
+	{"zrevrangebyscore", -4, ReadOnly, 1, 1, 1},
+	{"zrevrank", -3, ReadOnly | Fast, 1, 1, 1},
+	{"zscan", -3, ReadOnly | Random, 1, 1, 1},
+	{"zscore", 3, ReadOnly | Fast, 1, 1, 1},
+	{"zunion", -3, ReadOnly | MovableKeys, 0, 0, 0},
+	{"zunionstore", -4, Write | Denyoom | MovableKeys, 1, 1, 1},
+}
@@ -0,0 +1,281 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Flag describes a property of a redis command (same meaning as the flags returned by COMMAND)
+type Flag uint32
+
+const (
+	Write Flag = 1 << iota
+	ReadOnly
+	Denyoom
+	Admin
+	PubSub
+	NoScript
+	Random
+	Blocking
+	Loading
+	Stale
+	SkipMonitor
+	Fast
+	MovableKeys
+	NoAuth
+)
+
+var flagNames = map[string]Flag{
+	"write":        Write,
+	"readonly":     ReadOnly,
+	"denyoom":      Denyoom,
+	"admin":        Admin,
+	"pubsub":       PubSub,
+	"noscript":     NoScript,
+	"random":       Random,
+	"blocking":     Blocking,
+	"loading":      Loading,
+	"stale":        Stale,
+	"skip_monitor": SkipMonitor,
+	"fast":         Fast,
+	"movablekeys":  MovableKeys,
+	"no_auth":      NoAuth,
+}
+
+// ParseFlag returns the flag with the given COMMAND name (0 if unknown)
+func ParseFlag(name string) Flag {
+	return flagNames[strings.ToLower(name)]
+}
+
+// Info describes a redis command: arity (negative means at least that many arguments, command included),
+// flags and the position of its keys
+type Info struct {
+	Name     string
+	Arity    int
+	Flags    Flag
+	FirstKey int
+	LastKey  int // negative counts from the end
+	Step     int
+}
+
+func (i *Info) Has(flag Flag) bool {
+	return i.Flags&flag != 0
+}
+
+// IsReadOnly returns true if the command can be served by a slave
+func (i *Info) IsReadOnly() bool {
+	return i.Has(ReadOnly) && !i.Has(Write) && !i.Has(Blocking)
+}
+
+// IsCacheable returns true if the same command always gets the same reply as long as the data doesn't change
+func (i *Info) IsCacheable() bool {
+	return i.IsReadOnly() && !i.Has(Random) && (i.FirstKey > 0 || i.Has(MovableKeys))
+}
+
+// categories are the redis ACL categories the proxy can tell from the command flags
+var categories = map[string]func(i *Info) bool{
+	"all":      func(i *Info) bool { return true },
+	"read":     func(i *Info) bool { return i.Has(ReadOnly) },
+	"write":    func(i *Info) bool { return i.Has(Write) },
+	"admin":    func(i *Info) bool { return i.Has(Admin) },
+	"pubsub":   func(i *Info) bool { return i.Has(PubSub) },
+	"blocking": func(i *Info) bool { return i.Has(Blocking) },
+	"fast":     func(i *Info) bool { return i.Has(Fast) },
+	"slow":     func(i *Info) bool { return !i.Has(Fast) },
+	"keyspace": func(i *Info) bool { return i.FirstKey > 0 || i.Has(MovableKeys) },
+}
+
+// IsCategory returns true if name (with or without the leading @) is a category known to InCategory
+func IsCategory(name string) bool {
+	_, ok := categories[strings.TrimPrefix(strings.ToLower(name), "@")]
+	return ok
+}
+
+// InCategory returns true if the command belongs to the ACL category (with or without the leading @)
+func (i *Info) InCategory(name string) bool {
+
+	inCategory, ok := categories[strings.TrimPrefix(strings.ToLower(name), "@")]
+
+	return ok && inCategory(i)
+}
+
+// CheckArity returns true if args (command included) has an acceptable number of arguments
+func (i *Info) CheckArity(args []string) bool {
+
+	if i.Arity >= 0 {
+		return len(args) == i.Arity
+	}
+
+	return len(args) >= -i.Arity
+}
+
+// Keys returns the keys in args (command included) in the order they appear
+func (i *Info) Keys(args []string) []string {
+
+	if !i.CheckArity(args) {
+		return nil
+	}
+
+	if i.Has(MovableKeys) {
+		if keys, ok := movableKeys(i.Name, args); ok {
+			return keys
+		}
+	}
+
+	if i.FirstKey <= 0 || i.FirstKey >= len(args) {
+		return nil
+	}
+
+	last := i.LastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+
+	step := i.Step
+	if step <= 0 {
+		step = 1
+	}
+
+	keys := make([]string, 0, (last-i.FirstKey)/step+1)
+
+	for k := i.FirstKey; k <= last; k += step {
+		keys = append(keys, args[k])
+	}
+
+	return keys
+}
+
+// movableKeys finds the keys of the commands whose keys can't be described by first / last / step
+func movableKeys(name string, args []string) ([]string, bool) {
+
+	switch name {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		// EVAL script numkeys key [key ...] arg [arg ...]
+		return numKeys(args, 2, 3)
+
+	case "zunion", "zinter", "zdiff", "zintercard", "sintercard", "lmpop", "zmpop":
+		// ZUNION numkeys key [key ...] ...
+		return numKeys(args, 1, 2)
+
+	case "blmpop", "bzmpop":
+		// BLMPOP timeout numkeys key [key ...] ...
+		return numKeys(args, 2, 3)
+
+	case "zunionstore", "zinterstore", "zdiffstore":
+		// ZUNIONSTORE destination numkeys key [key ...] ...
+		keys, ok := numKeys(args, 2, 3)
+		if !ok {
+			return nil, false
+		}
+		return append([]string{args[1]}, keys...), true
+
+	case "xread", "xreadgroup":
+		// ... STREAMS key [key ...] id [id ...]
+		for k := 1; k < len(args); k++ {
+			if strings.ToLower(args[k]) == "streams" {
+				rest := args[k+1:]
+				if len(rest) == 0 || len(rest)%2 != 0 {
+					return nil, false
+				}
+				return rest[0 : len(rest)/2], true
+			}
+		}
+		return nil, false
+
+	case "sort", "sort_ro":
+		// SORT key ... [STORE destination]
+		keys := []string{args[1]}
+		for k := 2; k < len(args)-1; k++ {
+			if strings.ToLower(args[k]) == "store" {
+				keys = append(keys, args[k+1])
+			}
+		}
+		return keys, true
+
+	case "georadius", "georadiusbymember":
+		// GEORADIUS key ... [STORE key] [STOREDIST key]
+		keys := []string{args[1]}
+		for k := 2; k < len(args)-1; k++ {
+			switch strings.ToLower(args[k]) {
+			case "store", "storedist":
+				keys = append(keys, args[k+1])
+			}
+		}
+		return keys, true
+
+	case "migrate":
+		// MIGRATE host port key|"" db timeout ... [KEYS key [key ...]]
+		if args[3] != "" {
+			return []string{args[3]}, true
+		}
+		for k := 6; k < len(args); k++ {
+			if strings.ToLower(args[k]) == "keys" {
+				return args[k+1:], true
+			}
+		}
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// numKeys reads the key count at args[countPos], the keys follow from args[firstPos]
+func numKeys(args []string, countPos, firstPos int) ([]string, bool) {
+
+	if countPos >= len(args) {
+		return nil, false
+	}
+
+	count, err := strconv.Atoi(args[countPos])
+
+	if err != nil || count < 0 || firstPos+count > len(args) {
+		return nil, false
+	}
+
+	return args[firstPos : firstPos+count], true
+}
+
+// Table is the list of commands known to the proxy
+type Table struct {
+	commands map[string]*Info
+}
+
+func NewTable(infoList []Info) *Table {
+
+	t := &Table{commands: make(map[string]*Info, len(infoList))}
+
+	for index := range infoList {
+		info := &infoList[index]
+		info.Name = strings.ToLower(info.Name)
+		t.commands[info.Name] = info
+	}
+
+	return t
+}
+
+// Default returns the built in table of redis commands
+func Default() *Table {
+
+	infoList := make([]Info, len(defaultCommands))
+	copy(infoList, defaultCommands)
+
+	return NewTable(infoList)
+}
+
+// Lookup returns the command info or nil if the command is unknown
+func (t *Table) Lookup(name string) *Info {
+
+	if info, ok := t.commands[name]; ok {
+		return info
+	}
+
+	return t.commands[strings.ToLower(name)]
+}
+
+func (t *Table) Len() int {
+	return len(t.commands)
+}
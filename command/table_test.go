@@ -0,0 +1,63 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"GET", "a"}, []string{"a"}},
+		{[]string{"mset", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"blpop", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"eval", "s", "2", "a", "b", "x"}, []string{"a", "b"}},
+		{[]string{"xread", "COUNT", "2", "STREAMS", "a", "b", "0", "0"}, []string{"a", "b"}},
+		{[]string{"zunionstore", "d", "2", "a", "b"}, []string{"d", "a", "b"}},
+		{[]string{"get"}, nil},
+	}
+
+	table := Default()
+
+	for _, test := range tests {
+
+		keys := table.Lookup(test.args[0]).Keys(test.args)
+
+		if len(keys) == 0 && len(test.keys) == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%v: got %v, want %v", test.args, keys, test.keys)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+
+	table := Default()
+
+	tests := []struct {
+		name      string
+		readOnly  bool
+		cacheable bool
+	}{
+		{"get", true, true},
+		{"ttl", true, false},
+		{"srandmember", true, false},
+		{"set", false, false},
+		{"blpop", false, false},
+	}
+
+	for _, test := range tests {
+
+		info := table.Lookup(test.name)
+
+		if info.IsReadOnly() != test.readOnly || info.IsCacheable() != test.cacheable {
+			t.Errorf("%s: read only %v, cacheable %v", test.name, info.IsReadOnly(), info.IsCacheable())
+		}
+	}
+}
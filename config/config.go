@@ -0,0 +1,209 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config is the hargo configuration, read from a JSON file
+type Config struct {
+	// redis master to start from (sentinels are discovered through it)
+	MasterHost string `json:"master_host"`
+	MasterPort int    `json:"master_port"`
+
+	// routing rules, the first matching rule wins
+	Rules []Rule `json:"rules"`
+
+	// read-your-writes consistency for client sessions
+	Consistency Consistency `json:"consistency"`
+
+	// slaves lagging behind the master are taken out of the read rotation
+	Replication Replication `json:"replication"`
+
+	// how reads are spread across the slaves
+	Balancing Balancing `json:"balancing"`
+
+	// datacenter / availability zone affinity for slave reads
+	Locality Locality `json:"locality"`
+
+	// blocking commands (BLPOP, XREAD BLOCK...)
+	Blocking Blocking `json:"blocking"`
+
+	// credentials sent by the proxy to redis and to the sentinels
+	Auth Auth `json:"auth"`
+
+	// client accounts of the proxy, none means no authentication
+	Users []User `json:"users"`
+
+	// keys spread across several master groups
+	Sharding Sharding `json:"sharding"`
+
+	// redis cluster mode, replaces the sentinels
+	Cluster Cluster `json:"cluster"`
+}
+
+// Rule overrides the routing of the commands it matches. Empty fields match anything
+type Rule struct {
+	// command name (case insensitive)
+	Command string `json:"command"`
+	// glob pattern matched against the command keys (any key matching is enough)
+	Key string `json:"key"`
+	// client address: a glob pattern on the IP or a CIDR block
+	Client string `json:"client"`
+	// one of master, slave, deny, nocache
+	Action string `json:"action"`
+}
+
+// Consistency sends the reads of a client to the master for a while after it wrote
+type Consistency struct {
+	// off, session (all reads of the session) or keys (only reads of the keys written)
+	Mode string `json:"mode"`
+	// how long after a write the reads stay on the master
+	WindowMs int `json:"window_ms"`
+}
+
+// Replication sets how far behind the master a slave can be and still serve reads (0 disables a check)
+type Replication struct {
+	// how often each slave's INFO replication is polled
+	CheckIntervalMs int `json:"check_interval_ms"`
+	// replication offset difference with the master
+	MaxLagBytes int64 `json:"max_lag_bytes"`
+	// master_last_io_seconds_ago
+	MaxLastIOSeconds int `json:"max_last_io_seconds"`
+}
+
+// Balancing picks the slave serving each read
+type Balancing struct {
+	// random, round_robin, least_outstanding, ewma or weighted
+	Strategy string `json:"strategy"`
+	// host:port => weight for the weighted strategy (1 when missing)
+	Weights map[string]int `json:"weights"`
+}
+
+// Locality labels the redis instances so that reads prefer the slaves close to the proxy
+type Locality struct {
+	// label of the proxy itself, empty disables the affinity
+	Local string `json:"local"`
+	// host:port => label
+	Endpoints map[string]string `json:"endpoints"`
+	// glob on host:port => label, checked in order when the address is not in Endpoints
+	Patterns []LocalityPattern `json:"patterns"`
+}
+
+type LocalityPattern struct {
+	Host  string `json:"host"`
+	Label string `json:"label"`
+}
+
+// Blocking limits the blocking commands, each one holds its own master connection while it waits
+type Blocking struct {
+	// blocked clients at the same time, the next ones get an error (0 means no limit)
+	MaxClients int `json:"max_clients"`
+}
+
+// Auth holds the credentials of each role: redis (master and slaves) and sentinel
+type Auth struct {
+	Redis    Credentials `json:"redis"`
+	Sentinel Credentials `json:"sentinel"`
+}
+
+// Credentials are sent with AUTH on every new connection. No password means no AUTH,
+// no username authenticates as the default user
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// User is a client account of the proxy with its access policy
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// ACL categories the user can run (read, write, admin, pubsub, blocking, fast, slow, keyspace, all), empty allows all
+	Categories []string `json:"categories"`
+	// glob patterns every key of a command must match, empty allows all
+	Keys []string `json:"keys"`
+	// no command flagged as write
+	ReadOnly bool `json:"read_only"`
+}
+
+// Sharding spreads the keys across several master groups monitored by the same sentinels
+type Sharding struct {
+	// sentinel names of the master groups, empty means a single group (the one of the configured master)
+	Masters []string `json:"masters"`
+	// hash_slot (CRC16 of the hash tag, the same as redis cluster) or consistent_hash
+	Distribution string `json:"distribution"`
+}
+
+// Cluster fronts a redis cluster: the slot map is loaded from the cluster and kept up to date
+type Cluster struct {
+	// host:port of a few cluster nodes to start from, empty disables the cluster mode
+	Nodes []string `json:"nodes"`
+}
+
+// Default returns the configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		MasterHost: "127.0.0.1",
+		MasterPort: 6379,
+		Rules:      make([]Rule, 0),
+		Consistency: Consistency{
+			Mode:     "off",
+			WindowMs: 1000,
+		},
+		Replication: Replication{
+			CheckIntervalMs:  1000,
+			MaxLagBytes:      1024 * 1024,
+			MaxLastIOSeconds: 10,
+		},
+		Balancing: Balancing{
+			Strategy: "round_robin",
+			Weights:  make(map[string]int),
+		},
+		Locality: Locality{
+			Endpoints: make(map[string]string),
+			Patterns:  make([]LocalityPattern, 0),
+		},
+		Blocking: Blocking{
+			MaxClients: 100,
+		},
+		Users: make([]User, 0),
+		Sharding: Sharding{
+			Masters:      make([]string, 0),
+			Distribution: "hash_slot",
+		},
+		Cluster: Cluster{
+			Nodes: make([]string, 0),
+		},
+	}
+}
+
+// Load reads the configuration from path, missing values keep their defaults.
+// An empty path returns the default configuration
+func Load(path string) (*Config, error) {
+
+	cfg := Default()
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Config: Unable to read '%s' because %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Config: Unable to parse '%s' because %v", path, err)
+	}
+
+	for _, pattern := range cfg.Locality.Patterns {
+		if _, err := filepath.Match(pattern.Host, ""); err != nil {
+			return nil, fmt.Errorf("Config: Invalid locality pattern '%s' because %v", pattern.Host, err)
+		}
+	}
+
+	return cfg, nil
+}
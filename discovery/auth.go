@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"hargo/config"
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"net"
+	"strconv"
+	"time"
+)
+
+// authArgs returns the AUTH command for the credentials, nil if there is no password
+func authArgs(credentials config.Credentials) []string {
+
+	if credentials.Password == "" {
+		return nil
+	}
+
+	if credentials.Username == "" {
+		return []string{"AUTH", credentials.Password}
+	}
+
+	return []string{"AUTH", credentials.Username, credentials.Password}
+}
+
+// dial opens a radix client to hostPort and authenticates it
+func dial(hostPort string, credentials config.Credentials) (*redis.Client, error) {
+
+	client, err := redis.DialTimeout("tcp", hostPort, time.Duration(5)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	args := authArgs(credentials)
+
+	if args == nil {
+		return client, nil
+	}
+
+	cmdArgs := make([]interface{}, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		cmdArgs = append(cmdArgs, arg)
+	}
+
+	if r := client.Cmd("auth", cmdArgs...); r.Err != nil {
+		client.Close()
+		return nil, fmt.Errorf("AUTH failed on %s: %v", hostPort, r.Err)
+	}
+
+	return client, nil
+}
+
+// authenticate sends AUTH on a raw connection that was just opened and checks the reply
+func authenticate(conn net.Conn, credentials config.Credentials) error {
+
+	args := authArgs(credentials)
+
+	if args == nil {
+		return nil
+	}
+
+	if err := handshake(conn, args); err != nil {
+		return fmt.Errorf("AUTH refused: %v", err)
+	}
+
+	return nil
+}
+
+// handshake runs a command with a single line reply (+OK or an error) on a raw connection
+// that was just opened
+func handshake(conn net.Conn, args []string) error {
+
+	src := make([]byte, 0, 64)
+	src = append(src, '*')
+	src = strconv.AppendInt(src, int64(len(args)), 10)
+	src = append(src, '\r', '\n')
+
+	for _, arg := range args {
+		src = append(src, '$')
+		src = strconv.AppendInt(src, int64(len(arg)), 10)
+		src = append(src, '\r', '\n')
+		src = append(src, arg...)
+		src = append(src, '\r', '\n')
+	}
+
+	// we time out after 5 seconds
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(src); err != nil {
+		return err
+	}
+
+	// the reply is a single line: +OK or an error
+	reply := make([]byte, 0, 64)
+	buf := make([]byte, 64)
+
+	for bytes.IndexByte(reply, '\n') == -1 {
+
+		read, err := conn.Read(buf)
+
+		if err != nil {
+			return err
+		}
+
+		reply = append(reply, buf[0:read]...)
+	}
+
+	if reply[0] != '+' {
+		return fmt.Errorf("%s", string(bytes.TrimSpace(reply)))
+	}
+
+	return nil
+}
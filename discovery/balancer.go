@@ -0,0 +1,150 @@
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// Balancer picks the slave serving the next read among the ones in rotation (never an empty list)
+type Balancer interface {
+	Pick(endpointList []*Endpoint) *Endpoint
+}
+
+// NewBalancer returns the balancer for the given strategy: random, round_robin, least_outstanding,
+// ewma (latency weighted) or weighted (static weights per host:port, 1 by default)
+func NewBalancer(strategy string, weights map[string]int) (Balancer, error) {
+
+	switch strings.ToLower(strategy) {
+	case "random":
+		return &randomBalancer{}, nil
+	case "", "round_robin":
+		return &roundRobinBalancer{}, nil
+	case "least_outstanding":
+		return &leastOutstandingBalancer{}, nil
+	case "ewma":
+		return &ewmaBalancer{}, nil
+	case "weighted":
+		return &weightedBalancer{weights: weights}, nil
+	}
+
+	return nil, fmt.Errorf("Balancer: unknown strategy '%s'", strategy)
+}
+
+type randomBalancer struct{}
+
+func (b *randomBalancer) Pick(endpointList []*Endpoint) *Endpoint {
+	return endpointList[rand.Intn(len(endpointList))]
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) Pick(endpointList []*Endpoint) *Endpoint {
+	next := atomic.AddUint64(&b.next, 1)
+	return endpointList[next%uint64(len(endpointList))]
+}
+
+// leastOutstandingBalancer picks the slave with the fewest connections in use (ties are broken randomly)
+type leastOutstandingBalancer struct{}
+
+func (b *leastOutstandingBalancer) Pick(endpointList []*Endpoint) *Endpoint {
+
+	offset := rand.Intn(len(endpointList))
+	best := endpointList[offset]
+
+	for i := 1; i < len(endpointList); i++ {
+
+		endpoint := endpointList[(offset+i)%len(endpointList)]
+
+		if endpoint.Outstanding() < best.Outstanding() {
+			best = endpoint
+		}
+	}
+
+	return best
+}
+
+// ewmaBalancer picks a slave at random with a probability inversely proportional to its average latency
+// multiplied by the requests it is already serving. Slaves with no measure yet get the best latency seen
+type ewmaBalancer struct{}
+
+func (b *ewmaBalancer) Pick(endpointList []*Endpoint) *Endpoint {
+
+	best := 0.0
+	for _, endpoint := range endpointList {
+		if latency := endpoint.Latency(); latency > 0 && (best == 0 || latency < best) {
+			best = latency
+		}
+	}
+
+	// nothing measured so far
+	if best == 0 {
+		return endpointList[rand.Intn(len(endpointList))]
+	}
+
+	scoreList := make([]float64, len(endpointList))
+	total := 0.0
+
+	for index, endpoint := range endpointList {
+
+		latency := endpoint.Latency()
+		if latency == 0 {
+			latency = best
+		}
+
+		scoreList[index] = 1 / (latency * float64(endpoint.Outstanding()+1))
+		total += scoreList[index]
+	}
+
+	pick := rand.Float64() * total
+
+	for index, score := range scoreList {
+		pick -= score
+		if pick <= 0 {
+			return endpointList[index]
+		}
+	}
+
+	return endpointList[len(endpointList)-1]
+}
+
+// weightedBalancer picks a slave at random proportionally to its configured weight
+type weightedBalancer struct {
+	weights map[string]int
+}
+
+func (b *weightedBalancer) weight(endpoint *Endpoint) int {
+
+	if weight, ok := b.weights[endpoint.HostPort()]; ok {
+		return weight
+	}
+
+	return 1
+}
+
+func (b *weightedBalancer) Pick(endpointList []*Endpoint) *Endpoint {
+
+	total := 0
+	for _, endpoint := range endpointList {
+		total += b.weight(endpoint)
+	}
+
+	// all the weights are 0
+	if total <= 0 {
+		return endpointList[rand.Intn(len(endpointList))]
+	}
+
+	pick := rand.Intn(total)
+
+	for _, endpoint := range endpointList {
+		pick -= b.weight(endpoint)
+		if pick < 0 {
+			return endpoint
+		}
+	}
+
+	return endpointList[len(endpointList)-1]
+}
@@ -0,0 +1,432 @@
+package discovery
+
+import (
+	"fmt"
+	"hargo/config"
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// the slot map is reloaded at this interval even without redirections
+	clusterRefreshInterval = 30 * time.Second
+	// and not more often than this on redirections
+	clusterRefreshMinInterval = time.Second
+)
+
+// clusterGroup is a master of the cluster with its replicas and the slot ranges it serves
+type clusterGroup struct {
+	master   string
+	replicas []string
+	// [start, end] pairs
+	ranges [][2]int
+}
+
+// newClusterShards loads the slot map from the configured cluster nodes. Each master of the cluster is
+// a shard with its replicas as slaves, slots go to the shard serving them
+func newClusterShards(cfg *config.Config) (*Shards, error) {
+
+	s := &Shards{cluster: true, cfg: cfg, shards: make([]*Discovery, 0)}
+
+	if err := s.refreshCluster(); err != nil {
+		return nil, fmt.Errorf("Shards: %v", err)
+	}
+
+	// we keep the slot map up to date
+	go func() {
+		for {
+			time.Sleep(clusterRefreshInterval)
+
+			if err := s.refreshCluster(); err != nil {
+				log.Printf("ERROR: refreshCluster: %v", err)
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// ByMaster returns the shard whose master is hostPort, nil if there is none
+func (s *Shards) ByMaster(hostPort string) *Discovery {
+
+	for _, shard := range s.All() {
+		if shard.MasterHostPort() == hostPort {
+			return shard
+		}
+	}
+
+	return nil
+}
+
+// Moved records a -MOVED redirection: the slot is now served by the master hostPort. It returns the
+// shard of that master, nil if it isn't known yet. The slot map is reloaded in the background either way
+func (s *Shards) Moved(slot int, hostPort string) *Discovery {
+
+	s.Refresh()
+
+	shard := s.ByMaster(hostPort)
+
+	if shard == nil || slot < 0 || slot >= SlotCount {
+		return shard
+	}
+
+	s.mutex.Lock()
+	for index := range s.shards {
+		if s.shards[index] == shard {
+			s.slots[slot] = index
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	return shard
+}
+
+// NewConn returns a dedicated connection to a cluster node, whether it is a known master or not
+func (s *Shards) NewConn(hostPort string) *ConnWrapper {
+	return NewConnWrapper(hostPort, hash(hostPort), s.cfg.Auth.Redis)
+}
+
+// Refresh reloads the slot map in the background. Only one reload runs at a time, and a reload that
+// just happened is not repeated
+func (s *Shards) Refresh() {
+
+	s.mutex.Lock()
+
+	if s.refreshing || time.Since(s.lastRefresh) < clusterRefreshMinInterval {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.refreshing = true
+	s.mutex.Unlock()
+
+	go func() {
+		if err := s.refreshCluster(); err != nil {
+			log.Printf("ERROR: refreshCluster: %v", err)
+		}
+	}()
+}
+
+// refreshCluster asks the cluster for its slot map and updates the shards: masters that are still
+// there (or got replaced by one of their replicas) keep their shard and connections, new masters get a
+// new shard and the ones that left are retired
+func (s *Shards) refreshCluster() error {
+
+	defer func() {
+		s.mutex.Lock()
+		s.refreshing = false
+		s.lastRefresh = time.Now()
+		s.mutex.Unlock()
+	}()
+
+	current := s.All()
+
+	// the known masters are asked first, the configured nodes are the last resort
+	nodeList := make([]string, 0, len(current)+len(s.cfg.Cluster.Nodes))
+	for _, shard := range current {
+		nodeList = append(nodeList, shard.MasterHostPort())
+	}
+	nodeList = append(nodeList, s.cfg.Cluster.Nodes...)
+
+	var groupList []*clusterGroup
+	var err error
+
+	for _, node := range nodeList {
+
+		groupList, err = readClusterGroups(node, s.cfg.Auth.Redis)
+
+		if err == nil {
+			break
+		}
+
+		log.Printf("ERROR: refreshCluster: %v", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("No cluster node could tell the slot map")
+	}
+
+	if len(groupList) == 0 {
+		return fmt.Errorf("The cluster has no slot assigned")
+	}
+
+	used := make(map[*Discovery]bool)
+	groupShards := make([]*Discovery, len(groupList))
+	added := make([]*Discovery, 0)
+
+	for index, group := range groupList {
+
+		shard := findClusterShard(current, group, used)
+
+		if shard == nil {
+
+			log.Printf("refreshCluster: New master %s", group.master)
+
+			shard = newDiscovery(s.cfg, group.master, group.master)
+			shard.cluster = true
+			shard.updateSlaves(group.replicas)
+			shard.startReplicationChecks()
+
+			added = append(added, shard)
+
+		} else {
+
+			// a replica may have taken over
+			shard.setMaster(group.master)
+
+			if shard.SlavesSignature() != slavesHash(group.replicas) {
+				shard.updateSlaves(group.replicas)
+			}
+
+			used[shard] = true
+		}
+
+		groupShards[index] = shard
+	}
+
+	// the shards we knew keep their order, the default one doesn't move for nothing
+	shardList := make([]*Discovery, 0, len(groupList))
+	for _, shard := range current {
+		if used[shard] {
+			shardList = append(shardList, shard)
+		}
+	}
+	shardList = append(shardList, added...)
+
+	positions := make(map[*Discovery]int)
+	for index, shard := range shardList {
+		positions[shard] = index
+	}
+
+	slots := make([]int, SlotCount)
+	for slot := range slots {
+		slots[slot] = -1
+	}
+
+	for index, group := range groupList {
+		for _, slotRange := range group.ranges {
+			for slot := slotRange[0]; slot <= slotRange[1] && slot < SlotCount; slot++ {
+				slots[slot] = positions[groupShards[index]]
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	s.shards = shardList
+	s.slots = slots
+	s.mutex.Unlock()
+
+	// the masters that left the cluster
+	for _, shard := range current {
+		if !used[shard] {
+			log.Printf("refreshCluster: Master %s left the cluster", shard.MasterHostPort())
+			shard.retire()
+		}
+	}
+
+	log.Printf("refreshCluster: %d masters serving the slots", len(shardList))
+
+	return nil
+}
+
+// findClusterShard returns the shard already following the group: the same master, or a master that
+// is now one of the replicas (failover), or a slave that is now the master
+func findClusterShard(current []*Discovery, group *clusterGroup, used map[*Discovery]bool) *Discovery {
+
+	for _, shard := range current {
+		if !used[shard] && shard.MasterHostPort() == group.master {
+			return shard
+		}
+	}
+
+	for _, shard := range current {
+
+		if used[shard] {
+			continue
+		}
+
+		for _, replica := range group.replicas {
+			if shard.MasterHostPort() == replica {
+				return shard
+			}
+		}
+
+		for _, endpoint := range shard.Slaves() {
+			if endpoint.HostPort() == group.master {
+				return shard
+			}
+		}
+	}
+
+	return nil
+}
+
+// readClusterGroups reads the slot map of the cluster from one of its nodes: CLUSTER SHARDS, or
+// CLUSTER SLOTS before redis 7
+func readClusterGroups(hostPort string, credentials config.Credentials) ([]*clusterGroup, error) {
+
+	client, err := dial(hostPort, credentials)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to cluster node %s => %v", hostPort, err)
+	}
+
+	defer client.Close()
+
+	if r := client.Cmd("cluster", "shards"); r.Err == nil {
+		return parseClusterShards(r)
+	}
+
+	r := client.Cmd("cluster", "slots")
+
+	if r.Err != nil {
+		return nil, fmt.Errorf("CLUSTER SLOTS failed on %s => %v", hostPort, r.Err)
+	}
+
+	return parseClusterSlots(r)
+}
+
+// parseClusterShards reads the CLUSTER SHARDS reply: for each shard its slot ranges and its nodes
+func parseClusterShards(r *redis.Reply) ([]*clusterGroup, error) {
+
+	groupList := make([]*clusterGroup, 0, len(r.Elems))
+
+	for _, shardReply := range r.Elems {
+
+		group := &clusterGroup{replicas: make([]string, 0)}
+
+		for i := 0; i+1 < len(shardReply.Elems); i += 2 {
+
+			field, _ := shardReply.Elems[i].Str()
+			value := shardReply.Elems[i+1]
+
+			switch field {
+			case "slots":
+
+				for j := 0; j+1 < len(value.Elems); j += 2 {
+
+					start, err1 := replyInt(value.Elems[j])
+					end, err2 := replyInt(value.Elems[j+1])
+
+					if err1 != nil || err2 != nil {
+						return nil, fmt.Errorf("Malformed CLUSTER SHARDS slot range")
+					}
+
+					group.ranges = append(group.ranges, [2]int{start, end})
+				}
+
+			case "nodes":
+
+				for _, nodeReply := range value.Elems {
+
+					node := make(map[string]string)
+					for j := 0; j+1 < len(nodeReply.Elems); j += 2 {
+						key, _ := nodeReply.Elems[j].Str()
+						node[key] = replyString(nodeReply.Elems[j+1])
+					}
+
+					nodeHostPort := node["ip"] + ":" + node["port"]
+
+					// nodes still loading or failed (an old master after a failover) serve nothing
+					if node["health"] != "" && node["health"] != "online" {
+						continue
+					}
+
+					if node["role"] == "master" {
+						group.master = nodeHostPort
+					} else {
+						group.replicas = append(group.replicas, nodeHostPort)
+					}
+				}
+			}
+		}
+
+		// shards without slots (empty masters) don't take any key
+		if group.master == "" || len(group.ranges) == 0 {
+			continue
+		}
+
+		sort.Strings(group.replicas)
+		groupList = append(groupList, group)
+	}
+
+	return groupList, nil
+}
+
+// parseClusterSlots reads the CLUSTER SLOTS reply: one entry per slot range with its master first,
+// the same master showing up for each of its ranges
+func parseClusterSlots(r *redis.Reply) ([]*clusterGroup, error) {
+
+	groupMap := make(map[string]*clusterGroup)
+	groupList := make([]*clusterGroup, 0)
+
+	for _, rangeReply := range r.Elems {
+
+		if len(rangeReply.Elems) < 3 {
+			return nil, fmt.Errorf("Malformed CLUSTER SLOTS reply")
+		}
+
+		start, err1 := replyInt(rangeReply.Elems[0])
+		end, err2 := replyInt(rangeReply.Elems[1])
+
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Malformed CLUSTER SLOTS slot range")
+		}
+
+		nodeList := make([]string, 0, len(rangeReply.Elems)-2)
+
+		for _, nodeReply := range rangeReply.Elems[2:] {
+
+			if len(nodeReply.Elems) < 2 {
+				return nil, fmt.Errorf("Malformed CLUSTER SLOTS node")
+			}
+
+			nodeList = append(nodeList, replyString(nodeReply.Elems[0])+":"+replyString(nodeReply.Elems[1]))
+		}
+
+		group, ok := groupMap[nodeList[0]]
+
+		if !ok {
+			group = &clusterGroup{master: nodeList[0], replicas: nodeList[1:]}
+			sort.Strings(group.replicas)
+			groupMap[group.master] = group
+			groupList = append(groupList, group)
+		}
+
+		group.ranges = append(group.ranges, [2]int{start, end})
+	}
+
+	return groupList, nil
+}
+
+// replyString returns a bulk, status or integer reply as a string
+func replyString(r *redis.Reply) string {
+
+	if r.Type == redis.IntegerReply {
+		value, _ := r.Int64()
+		return strconv.FormatInt(value, 10)
+	}
+
+	value, _ := r.Str()
+	return value
+}
+
+// replyInt returns an integer reply, or a bulk one holding an integer
+func replyInt(r *redis.Reply) (int, error) {
+
+	if r.Type == redis.IntegerReply {
+		return r.Int()
+	}
+
+	value, err := r.Str()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// replyOf reads a raw RESP reply through a radix client
+func replyOf(t *testing.T, raw string) *redis.Reply {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte(raw))
+			conn.Close()
+		}
+	}()
+
+	client, err := redis.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	return client.ReadReply()
+}
+
+func respBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func respInt(n int) string {
+	return ":" + strconv.Itoa(n) + "\r\n"
+}
+
+func respArray(elemList ...string) string {
+
+	raw := "*" + strconv.Itoa(len(elemList)) + "\r\n"
+	for _, elem := range elemList {
+		raw += elem
+	}
+
+	return raw
+}
+
+func respNode(ip string, port int, role, health string) string {
+	return respArray(respBulk("ip"), respBulk(ip), respBulk("port"), respInt(port), respBulk("role"), respBulk(role), respBulk("health"), respBulk(health))
+}
+
+func TestParseClusterShards(t *testing.T) {
+
+	raw := respArray(
+		respArray(
+			respBulk("slots"), respArray(respInt(0), respInt(99), respInt(200), respInt(299)),
+			respBulk("nodes"), respArray(
+				// the old master failed over to its replica
+				respNode("10.0.0.1", 7000, "master", "fail"),
+				respNode("10.0.0.2", 7000, "master", "online"),
+				respNode("10.0.0.3", 7000, "replica", "loading"),
+				respNode("10.0.0.4", 7000, "replica", "online"),
+			),
+		),
+		// a master without slots takes no key
+		respArray(
+			respBulk("slots"), respArray(),
+			respBulk("nodes"), respArray(respNode("10.0.0.5", 7000, "master", "online")),
+		),
+	)
+
+	groupList, err := parseClusterShards(replyOf(t, raw))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*clusterGroup{{master: "10.0.0.2:7000", replicas: []string{"10.0.0.4:7000"}, ranges: [][2]int{{0, 99}, {200, 299}}}}
+
+	if !reflect.DeepEqual(groupList, want) {
+		t.Fatalf("got %+v, want %+v", groupList[0], want[0])
+	}
+}
+
+func TestParseClusterSlots(t *testing.T) {
+
+	node := func(ip string, port int) string {
+		return respArray(respBulk(ip), respInt(port), respBulk("id"))
+	}
+
+	raw := respArray(
+		respArray(respInt(0), respInt(99), node("10.0.0.1", 7000), node("10.0.0.2", 7000)),
+		respArray(respInt(100), respInt(199), node("10.0.0.3", 7000)),
+		respArray(respInt(200), respInt(299), node("10.0.0.1", 7000), node("10.0.0.2", 7000)),
+	)
+
+	groupList, err := parseClusterSlots(replyOf(t, raw))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*clusterGroup{
+		{master: "10.0.0.1:7000", replicas: []string{"10.0.0.2:7000"}, ranges: [][2]int{{0, 99}, {200, 299}}},
+		{master: "10.0.0.3:7000", replicas: []string{}, ranges: [][2]int{{100, 199}}},
+	}
+
+	if !reflect.DeepEqual(groupList, want) {
+		t.Fatalf("got %+v %+v", groupList[0], groupList[1])
+	}
+}
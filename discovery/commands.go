@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"fmt"
+	"hargo/command"
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"log"
+)
+
+// updateCommands rebuilds the command table from the COMMAND output of the given redis instance.
+// On failure the current table is kept
+func (d *Discovery) updateCommands(hostPort string) {
+
+	log.Printf("updateCommands: Loading the command table from %s\n", hostPort)
+
+	client, err := dial(hostPort, d.auth.Redis)
+
+	if err != nil {
+		log.Printf("ERROR: updateCommands: Unable to connect to %s => %v", hostPort, err)
+		return
+	}
+
+	defer client.Close()
+
+	r := client.Cmd("command")
+
+	if r.Err != nil {
+		log.Printf("ERROR: updateCommands: COMMAND call failed %v", r.Err)
+		return
+	}
+
+	infoList := make([]command.Info, 0, len(r.Elems))
+	builtin := command.Default()
+
+	for _, elem := range r.Elems {
+
+		info, err := parseCommandInfo(elem)
+
+		if err != nil {
+			log.Printf("ERROR: updateCommands: Malformed COMMAND reply %v", err)
+			return
+		}
+
+		// a command we know as random stays so, whatever the version of redis says
+		if known := builtin.Lookup(info.Name); known != nil && known.Has(command.Random) {
+			info.Flags |= command.Random
+		}
+
+		infoList = append(infoList, info)
+	}
+
+	if len(infoList) == 0 {
+		log.Printf("ERROR: updateCommands: COMMAND returned no commands")
+		return
+	}
+
+	table := command.NewTable(infoList)
+
+	d.commandsMutex.Lock()
+	d.commands = table
+	d.commandsMutex.Unlock()
+
+	log.Printf("updateCommands: Loaded %d commands", table.Len())
+}
+
+// parseCommandInfo reads one COMMAND entry: name, arity, flags, first key, last key, step, ACL categories
+// and tips (and more we don't need). Redis 7 tells random commands by the nondeterministic_output tip
+// instead of the random flag
+func parseCommandInfo(r *redis.Reply) (command.Info, error) {
+
+	info := command.Info{}
+
+	if r.Type != redis.MultiReply || len(r.Elems) < 6 {
+		return info, fmt.Errorf("unexpected command entry %v", r)
+	}
+
+	var err error
+
+	if info.Name, err = r.Elems[0].Str(); err != nil {
+		return info, err
+	}
+
+	if info.Arity, err = r.Elems[1].Int(); err != nil {
+		return info, err
+	}
+
+	for _, flagReply := range r.Elems[2].Elems {
+
+		flag, err := flagReply.Str()
+
+		if err != nil {
+			return info, err
+		}
+
+		info.Flags |= command.ParseFlag(flag)
+	}
+
+	if info.FirstKey, err = r.Elems[3].Int(); err != nil {
+		return info, err
+	}
+
+	if info.LastKey, err = r.Elems[4].Int(); err != nil {
+		return info, err
+	}
+
+	if info.Step, err = r.Elems[5].Int(); err != nil {
+		return info, err
+	}
+
+	if len(r.Elems) > 7 {
+		for _, tipReply := range r.Elems[7].Elems {
+			if tip, _ := tipReply.Str(); tip == "nondeterministic_output" {
+				info.Flags |= command.Random
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// Commands returns the current command table
+func (d *Discovery) Commands() *command.Table {
+	d.commandsMutex.RLock()
+	defer d.commandsMutex.RUnlock()
+	return d.commands
+}
@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"fmt"
+	"hargo/config"
 	//"log"
 	"net"
 	"time"
@@ -12,10 +13,20 @@ type ConnWrapper struct {
 	redisConn net.Conn
 	connected bool
 	signature string
+	protocol  int
+	db        int
+
+	// sent with AUTH on every (re)connection
+	credentials config.Credentials
+	// READONLY is sent on every (re)connection (redis cluster replica)
+	readOnly bool
+
+	// slave endpoint the connection belongs to (nil for the master)
+	endpoint *Endpoint
 }
 
-func NewConnWrapper(hostPort, signature string) *ConnWrapper {
-	ret := &ConnWrapper{hostPort: hostPort, connected: false, signature: signature}
+func NewConnWrapper(hostPort, signature string, credentials config.Credentials) *ConnWrapper {
+	ret := &ConnWrapper{hostPort: hostPort, connected: false, signature: signature, protocol: 2, credentials: credentials}
 	ret.connect()
 	return ret
 }
@@ -33,8 +44,25 @@ func (c *ConnWrapper) connect() error {
 	if err != nil {
 		return fmt.Errorf("ConnWrapper: Unable to connect to '%s' because %v", c.hostPort, err)
 	}
+
+	if err = authenticate(c.redisConn, c.credentials); err != nil {
+		c.redisConn.Close()
+		return fmt.Errorf("ConnWrapper: Unable to authenticate to '%s' because %v", c.hostPort, err)
+	}
+
+	if c.readOnly {
+		if err = handshake(c.redisConn, []string{"READONLY"}); err != nil {
+			c.redisConn.Close()
+			return fmt.Errorf("ConnWrapper: Unable to send READONLY to '%s' because %v", c.hostPort, err)
+		}
+	}
+
 	c.connected = true
 
+	// a fresh connection always starts with RESP2 on database 0
+	c.protocol = 2
+	c.db = 0
+
 	//log.Printf("ConnWrapper: connected to %s", c.hostPort)
 
 	return nil
@@ -52,7 +80,8 @@ func (c *ConnWrapper) Read(b []byte) (n int, err error) {
 
 	n, err = c.redisConn.Read(b)
 
-	if err != nil {
+	// a read timeout leaves the connection usable, the caller decides what to do with it
+	if netErr, ok := err.(net.Error); err != nil && !(ok && netErr.Timeout()) {
 		c.connected = false
 	}
 
@@ -108,14 +137,66 @@ func (c *ConnWrapper) Signature() string {
 	return c.signature
 }
 
+func (c *ConnWrapper) Endpoint() *Endpoint {
+	return c.endpoint
+}
+
 func (c *ConnWrapper) HostPort() string {
 	return c.hostPort
 }
 
+// Protocol returns the RESP version negotiated on the connection (2 or 3)
+func (c *ConnWrapper) Protocol() int {
+	return c.protocol
+}
+
+func (c *ConnWrapper) SetProtocol(protocol int) {
+	c.protocol = protocol
+}
+
+// setReadOnly makes the connection serve reads as a redis cluster replica, now and after every reconnection
+func (c *ConnWrapper) setReadOnly() {
+
+	c.readOnly = true
+
+	if c.connected && handshake(c.redisConn, []string{"READONLY"}) != nil {
+		c.Disconnect()
+	}
+}
+
+// DB returns the database selected on the connection (-1 if unknown)
+func (c *ConnWrapper) DB() int {
+	return c.db
+}
+
+func (c *ConnWrapper) SetDB(db int) {
+	c.db = db
+}
+
 func (c *ConnWrapper) IsConnected() bool {
 	return c.connected
 }
 
+// Disconnect drops a connection left in an unknown state (i.e. a reply still pending):
+// it will reconnect on next use
+func (c *ConnWrapper) Disconnect() {
+
+	if c.redisConn != nil {
+		c.redisConn.Close()
+	}
+
+	c.connected = false
+}
+
+// Interrupt closes the connection under a read in progress, which fails at once. Unlike the other
+// methods it may be called from another goroutine while the connection is in use
+func (c *ConnWrapper) Interrupt() {
+
+	if conn := c.redisConn; conn != nil {
+		conn.Close()
+	}
+}
+
 func (c *ConnWrapper) Destroy() error {
 	if c.redisConn == nil {
 		return nil
@@ -1,10 +1,11 @@
 package discovery
 
 import (
-	"fmt"
+	"hargo/command"
+	"hargo/config"
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
 	"log"
-	"os"
-	"strconv"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -15,7 +16,12 @@ const (
 
 // mutexes
 
+// Discovery follows one replication group (a master and its slaves) through the sentinels,
+// or through the cluster slot map for a redis cluster shard
 type Discovery struct {
+	// sentinel name of the master group ("" follows the first master sentinel reports)
+	name string
+
 	sentinelsMutex       sync.RWMutex
 	sentinelHostPortList []string
 
@@ -26,87 +32,199 @@ type Discovery struct {
 
 	slavesMutex     sync.RWMutex
 	slavesSignature string
-	slavesCh        chan *ConnWrapper
-}
+	slaves          []*Endpoint
+	balancer        Balancer
 
-func NewDiscovery() *Discovery {
+	commandsMutex sync.RWMutex
+	commands      *command.Table
 
-	d := &Discovery{}
+	// scripts loaded through the proxy, replayed on every new master and slave (sha1 => body)
+	scriptsMutex sync.RWMutex
+	scripts      map[string]string
 
-	// we need to start with a master
-	var err error
-	var masterHost = "127.0.0.1"
-	var masterPort = 6379
+	locality              config.Locality
+	replication           config.Replication
+	auth                  config.Auth
+	masterMonitorMutex    sync.Mutex
+	masterMonitor         *redis.Client
+	masterMonitorHostPort string
+
+	// redis cluster shard: slave connections are sent READONLY
+	cluster bool
 
-	if len(os.Args) > 1 {
-		masterHost = os.Args[1]
+	// closed when the group is retired
+	done chan struct{}
+}
+
+// NewDiscovery starts following the master group name from its current master. The sentinels are
+// found through the master unless they are given
+func NewDiscovery(cfg *config.Config, name, masterHostPort string, sentinelHostPortList []string) *Discovery {
+
+	d := newDiscovery(cfg, name, masterHostPort)
+	d.sentinelHostPortList = sentinelHostPortList
+
+	// first synchronous update
+	if len(d.sentinelHostPortList) == 0 {
+		d.updateSentinels()
 	}
+	d.updateMasterSlaves()
 
-	if len(os.Args) > 2 {
-		masterPort, err = strconv.Atoi(os.Args[2])
+	// cleanup cache every minute
+	go func() {
 
-		if err != nil {
-			masterPort = 6379
+		timer := time.Tick(time.Duration(30) * time.Second)
+
+		for _ = range timer {
+			d.updateSentinels()
+			d.updateMasterSlaves()
 		}
+	}()
+
+	d.startReplicationChecks()
+
+	return d
+}
+
+// newDiscovery sets up the master pool of a replication group, without any slave
+func newDiscovery(cfg *config.Config, name, masterHostPort string) *Discovery {
+
+	d := &Discovery{name: name, replication: cfg.Replication, locality: cfg.Locality, auth: cfg.Auth}
+
+	var err error
+
+	d.balancer, err = NewBalancer(cfg.Balancing.Strategy, cfg.Balancing.Weights)
+	if err != nil {
+		log.Fatalf("NewDiscovery: %v", err)
 	}
 
-	// we set the master
-	d.masterHostPort = fmt.Sprintf("%s:%d", masterHost, masterPort)
-	d.sentinelHostPortList = make([]string, 0)
+	// we need to start with a master
+	d.masterHostPort = masterHostPort
 	d.masterCh = make(chan *ConnWrapper, conPerEndpoint)
-	d.slavesCh = make(chan *ConnWrapper, conPerEndpoint*3) // max 3 slaves
+	d.slaves = make([]*Endpoint, 0)
+	d.scripts = make(map[string]string)
+	d.done = make(chan struct{})
+
+	// the built in command table is used until the master tells us otherwise
+	d.commands = command.Default()
 
 	// we setup the master queue only
 	d.masterSignature = hash(d.masterHostPort)
 	for i := 0; i < conPerEndpoint; i++ {
-		d.masterCh <- NewConnWrapper(d.masterHostPort, d.masterSignature)
+		d.masterCh <- NewConnWrapper(d.masterHostPort, d.masterSignature, d.auth.Redis)
 	}
 	// no slaves to start with
 	d.slavesSignature = ""
 
 	log.Printf("StartDiscovery: starting with redis master: %s and no slaves\n", d.masterHostPort)
 
-	// first synchronous update
-	d.updateSentinels()
-	d.updateMasterSlaves()
+	d.updateCommands(d.masterHostPort)
+
+	return d
+}
+
+// startReplicationChecks takes the slaves lagging behind out of the read rotation until the group is retired
+func (d *Discovery) startReplicationChecks() {
+
+	if d.replication.CheckIntervalMs <= 0 {
+		return
+	}
 
-	// cleanup cache every minute
 	go func() {
 
-		timer := time.Tick(time.Duration(30) * time.Second)
+		ticker := time.NewTicker(time.Duration(d.replication.CheckIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
 
-		for _ = range timer {
-			d.updateSentinels()
-			d.updateMasterSlaves()
+		for {
+			select {
+			case <-ticker.C:
+				d.checkReplication()
+			case <-d.done:
+				return
+			}
 		}
 	}()
+}
 
-	return d
+// retire stops following a group that left the topology. Sessions still holding it keep working
+// with its master connections, the slave connections are closed as they come back
+func (d *Discovery) retire() {
+
+	close(d.done)
+	d.updateSlaves(nil)
+}
+
+// Name returns the sentinel name of the master group ("" if not named)
+func (d *Discovery) Name() string {
+	return d.name
 }
 
+// GetSlave returns a connection to a slave in the read rotation picked by the balancer, nil if there is none
+// (or if the slave picked left the topology while we were waiting for one of its connections).
+// Slaves in the same locality as the proxy are preferred, remote ones are used only if no local one is available
 func (d *Discovery) GetSlave() *ConnWrapper {
 
-	slavesSignature := d.SlavesSignature()
+	localList := make([]*Endpoint, 0, 4)
+	remoteList := make([]*Endpoint, 0, 4)
 
-	for {
-		conn := <-d.slavesCh
+	for _, endpoint := range d.Slaves() {
 
-		if slavesSignature == conn.Signature() {
-			return conn
+		if !endpoint.InRotation() {
+			continue
+		}
+
+		if d.locality.Local == "" || endpoint.Locality() == d.locality.Local {
+			localList = append(localList, endpoint)
+		} else {
+			remoteList = append(remoteList, endpoint)
+		}
+	}
+
+	if len(localList) > 0 {
+		return d.balancer.Pick(localList).get()
+	}
+
+	if len(remoteList) > 0 {
+		return d.balancer.Pick(remoteList).get()
+	}
+
+	return nil
+}
+
+// localityOf returns the locality label of a redis instance from the configuration ("" if unknown)
+func (d *Discovery) localityOf(hostPort string) string {
+
+	if label, ok := d.locality.Endpoints[hostPort]; ok {
+		return label
+	}
+
+	for _, pattern := range d.locality.Patterns {
+		if ok, _ := filepath.Match(pattern.Host, hostPort); ok {
+			return pattern.Label
 		}
 	}
+
+	return ""
 }
 
 func (d *Discovery) ReturnSlave(conn *ConnWrapper) {
 
-	slavesSignature := d.SlavesSignature()
+	// slave connections of endpoints no longer in the topology are closed
+	conn.endpoint.put(conn)
+}
 
-	if conn.Signature() != slavesSignature {
-		// we ignore slave connections with an outdated signature
-		return
+// ObserveLatency records the round trip of a request served by conn (used to balance reads)
+func (d *Discovery) ObserveLatency(conn *ConnWrapper, elapsed time.Duration) {
+
+	if conn.endpoint != nil {
+		conn.endpoint.observe(elapsed)
 	}
+}
 
-	d.slavesCh <- conn
+// Slaves returns the current slave endpoints
+func (d *Discovery) Slaves() []*Endpoint {
+	d.slavesMutex.RLock()
+	defer d.slavesMutex.RUnlock()
+	return d.slaves
 }
 
 func (d *Discovery) GetMaster() *ConnWrapper {
@@ -134,6 +252,24 @@ func (d *Discovery) ReturnMaster(conn *ConnWrapper) {
 	d.masterCh <- conn
 }
 
+// NewMasterConn opens a dedicated connection to the current master, outside of the pool
+// (i.e. for a subscriber). The caller destroys it
+func (d *Discovery) NewMasterConn() *ConnWrapper {
+
+	d.masterMutex.RLock()
+	hostPort, signature := d.masterHostPort, d.masterSignature
+	d.masterMutex.RUnlock()
+
+	return NewConnWrapper(hostPort, signature, d.auth.Redis)
+}
+
+// MasterHostPort returns the address of the current master
+func (d *Discovery) MasterHostPort() string {
+	d.masterMutex.RLock()
+	defer d.masterMutex.RUnlock()
+	return d.masterHostPort
+}
+
 func (d *Discovery) MasterSignature() string {
 	d.masterMutex.RLock()
 	defer d.masterMutex.RUnlock()
@@ -0,0 +1,283 @@
+package discovery
+
+import (
+	"fmt"
+	"hargo/config"
+	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint is a redis slave with its own pool of connections and its replication health
+type Endpoint struct {
+	hostPort string
+	locality string
+	pool     chan *ConnWrapper
+
+	mutex sync.RWMutex
+	// removed from the topology: its connections are closed when returned
+	retired bool
+	// closed on retirement, wakes up the sessions waiting for a connection
+	done chan struct{}
+	// too far behind the master to serve reads
+	lagging bool
+
+	// connection used to poll INFO replication
+	monitorMutex sync.Mutex
+	monitor      *redis.Client
+
+	credentials config.Credentials
+
+	// connections in use
+	outstanding int64
+
+	// exponentially weighted moving average of the round trips (in seconds)
+	latencyMutex sync.Mutex
+	latency      float64
+}
+
+const (
+	// weight of the last round trip in the latency average
+	latencyDecay = 0.3
+)
+
+// newEndpoint opens the pool of a slave, readOnly sends READONLY on every connection (redis cluster replicas)
+func newEndpoint(hostPort, locality string, credentials config.Credentials, readOnly bool) *Endpoint {
+
+	e := &Endpoint{hostPort: hostPort, locality: locality, credentials: credentials}
+	e.pool = make(chan *ConnWrapper, conPerEndpoint)
+	e.done = make(chan struct{})
+
+	for i := 0; i < conPerEndpoint; i++ {
+		conn := NewConnWrapper(hostPort, hash(hostPort), credentials)
+		conn.endpoint = e
+
+		if readOnly {
+			conn.setReadOnly()
+		}
+
+		e.pool <- conn
+	}
+
+	return e
+}
+
+func (e *Endpoint) HostPort() string {
+	return e.hostPort
+}
+
+// Locality returns the datacenter / zone label of the endpoint ("" if unknown)
+func (e *Endpoint) Locality() string {
+	return e.locality
+}
+
+// InRotation returns true if the endpoint can serve reads
+func (e *Endpoint) InRotation() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return !e.retired && !e.lagging
+}
+
+func (e *Endpoint) isActive() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return !e.retired
+}
+
+// Outstanding returns the number of connections currently in use
+func (e *Endpoint) Outstanding() int64 {
+	return atomic.LoadInt64(&e.outstanding)
+}
+
+// Latency returns the average round trip in seconds (0 if never measured)
+func (e *Endpoint) Latency() float64 {
+	e.latencyMutex.Lock()
+	defer e.latencyMutex.Unlock()
+	return e.latency
+}
+
+func (e *Endpoint) observe(elapsed time.Duration) {
+
+	e.latencyMutex.Lock()
+	defer e.latencyMutex.Unlock()
+
+	if e.latency == 0 {
+		e.latency = elapsed.Seconds()
+		return
+	}
+
+	e.latency = latencyDecay*elapsed.Seconds() + (1-latencyDecay)*e.latency
+}
+
+// get waits for a connection of the pool, it returns nil if the endpoint is retired meanwhile
+func (e *Endpoint) get() *ConnWrapper {
+
+	atomic.AddInt64(&e.outstanding, 1)
+
+	select {
+	case conn := <-e.pool:
+		return conn
+	case <-e.done:
+		atomic.AddInt64(&e.outstanding, -1)
+		return nil
+	}
+}
+
+func (e *Endpoint) put(conn *ConnWrapper) {
+
+	atomic.AddInt64(&e.outstanding, -1)
+
+	if !e.isActive() {
+		conn.Destroy()
+		return
+	}
+
+	e.pool <- conn
+}
+
+// retire takes the endpoint out of the topology and closes its idle connections
+func (e *Endpoint) retire() {
+
+	e.mutex.Lock()
+	if e.retired {
+		e.mutex.Unlock()
+		return
+	}
+	e.retired = true
+	close(e.done)
+	e.mutex.Unlock()
+
+	e.monitorMutex.Lock()
+	if e.monitor != nil {
+		e.monitor.Close()
+		e.monitor = nil
+	}
+	e.monitorMutex.Unlock()
+
+	for {
+		select {
+		case conn := <-e.pool:
+			conn.Destroy()
+		default:
+			return
+		}
+	}
+}
+
+// checkReplication polls INFO replication and takes the slave out of the read rotation when it lags
+// too much behind the master (masterOffset < 0 if unknown). It goes back as soon as it catches up:
+// it returns true when that happens
+func (e *Endpoint) checkReplication(masterOffset int64, maxLagBytes int64, maxLastIO int) bool {
+
+	info, err := e.replicationInfo()
+
+	lagging := false
+	reason := ""
+
+	switch {
+	case err != nil:
+		lagging, reason = true, err.Error()
+
+	case info["master_link_status"] != "up":
+		lagging, reason = true, "master link is "+info["master_link_status"]
+
+	case info["master_sync_in_progress"] == "1":
+		lagging, reason = true, "resync in progress"
+
+	default:
+
+		lastIO, err := strconv.Atoi(info["master_last_io_seconds_ago"])
+
+		if err == nil && maxLastIO > 0 && lastIO > maxLastIO {
+			lagging, reason = true, fmt.Sprintf("last master I/O %d seconds ago", lastIO)
+			break
+		}
+
+		slaveOffset, err := strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+
+		if err == nil && masterOffset >= 0 && maxLagBytes > 0 && masterOffset-slaveOffset > maxLagBytes {
+			lagging, reason = true, fmt.Sprintf("%d bytes behind the master", masterOffset-slaveOffset)
+		}
+	}
+
+	e.mutex.Lock()
+	changed := e.lagging != lagging
+	e.lagging = lagging
+	e.mutex.Unlock()
+
+	if changed && lagging {
+		log.Printf("checkReplication: slave %s out of the read rotation: %s", e.hostPort, reason)
+	} else if changed {
+		log.Printf("checkReplication: slave %s back in the read rotation", e.hostPort)
+	}
+
+	return changed && !lagging
+}
+
+// replicationInfo returns the INFO replication fields of the endpoint
+func (e *Endpoint) replicationInfo() (map[string]string, error) {
+
+	e.monitorMutex.Lock()
+	defer e.monitorMutex.Unlock()
+
+	if !e.isActive() {
+		return nil, fmt.Errorf("retired")
+	}
+
+	if e.monitor == nil {
+
+		monitor, err := dial(e.hostPort, e.credentials)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.monitor = monitor
+	}
+
+	info, err := readInfo(e.monitor, "replication")
+
+	if err != nil {
+		e.monitor.Close()
+		e.monitor = nil
+	}
+
+	return info, err
+}
+
+// readInfo runs INFO <section> and returns its key value pairs
+func readInfo(client *redis.Client, section string) (map[string]string, error) {
+
+	r := client.Cmd("info", section)
+
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	str, err := r.Str()
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string)
+
+	for _, line := range strings.Split(str, "\n") {
+
+		line = strings.TrimSpace(line)
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if index := strings.IndexByte(line, ':'); index > 0 {
+			info[line[0:index]] = line[index+1:]
+		}
+	}
+
+	return info, nil
+}
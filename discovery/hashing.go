@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"hash/crc32"
+	"strings"
+)
+
+const (
+	// number of hash slots, the same as redis cluster
+	SlotCount = 16384
+)
+
+var crc16Table [256]uint16
+
+func init() {
+
+	// CRC16-CCITT (XMODEM), the one redis cluster uses
+	for i := 0; i < 256; i++ {
+
+		crc := uint16(i) << 8
+
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(src string) uint16 {
+
+	crc := uint16(0)
+
+	for i := 0; i < len(src); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^src[i]]
+	}
+
+	return crc
+}
+
+// HashTag returns the part of the key that is hashed: the content of the first {...} if it is not empty,
+// the whole key otherwise. Keys with the same hash tag always land on the same shard
+func HashTag(key string) string {
+
+	start := strings.IndexByte(key, '{')
+
+	if start == -1 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], '}')
+
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
+
+// HashSlot returns the redis cluster hash slot of a key
+func HashSlot(key string) int {
+	return int(crc16(HashTag(key)) % SlotCount)
+}
+
+// ringHash places keys and shards on the consistent hash ring
+func ringHash(src string) uint32 {
+	return crc32.ChecksumIEEE([]byte(src))
+}
@@ -0,0 +1,40 @@
+package discovery
+
+import "testing"
+
+func TestHashSlot(t *testing.T) {
+
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Fatalf("crc16: %x", crc)
+	}
+
+	tests := map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": HashSlot("user1000"),
+		"foo{}{bar}":           HashSlot("foo{}{bar}"),
+	}
+
+	for key, want := range tests {
+		if got := HashSlot(key); got != want {
+			t.Errorf("HashSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+
+	tests := map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar":              "foo{bar",
+		"plain":                "plain",
+	}
+
+	for key, want := range tests {
+		if got := HashTag(key); got != want {
+			t.Errorf("HashTag(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
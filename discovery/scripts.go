@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+// RegisterScript keeps a script loaded through the proxy and loads it on the master and every slave
+// so that EVALSHA and EVALSHA_RO find it wherever they land. It returns once they all have it
+func (d *Discovery) RegisterScript(script string) {
+
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	d.scriptsMutex.Lock()
+	_, known := d.scripts[sha]
+	d.scripts[sha] = script
+	d.scriptsMutex.Unlock()
+
+	if known {
+		return
+	}
+
+	// the instances load it at the same time
+	hostPortList := []string{d.MasterHostPort()}
+	for _, endpoint := range d.Slaves() {
+		hostPortList = append(hostPortList, endpoint.HostPort())
+	}
+
+	var wg sync.WaitGroup
+
+	for _, hostPort := range hostPortList {
+
+		wg.Add(1)
+
+		go func(hostPort string) {
+			defer wg.Done()
+			d.loadScripts(hostPort, []string{script})
+		}(hostPort)
+	}
+
+	wg.Wait()
+}
+
+// FlushScripts forgets the registered scripts and flushes them from the master and the slaves
+func (d *Discovery) FlushScripts() {
+
+	d.scriptsMutex.Lock()
+	d.scripts = make(map[string]string)
+	d.scriptsMutex.Unlock()
+
+	go func() {
+
+		hostPortList := []string{d.MasterHostPort()}
+		for _, endpoint := range d.Slaves() {
+			hostPortList = append(hostPortList, endpoint.HostPort())
+		}
+
+		for _, hostPort := range hostPortList {
+
+			client, err := dial(hostPort, d.auth.Redis)
+
+			if err != nil {
+				log.Printf("ERROR: FlushScripts: Unable to connect to %s => %v", hostPort, err)
+				continue
+			}
+
+			if r := client.Cmd("script", "flush"); r.Err != nil {
+				log.Printf("ERROR: FlushScripts: SCRIPT FLUSH failed on %s => %v", hostPort, r.Err)
+			}
+
+			client.Close()
+		}
+	}()
+}
+
+// scriptList returns the bodies of the registered scripts
+func (d *Discovery) scriptList() []string {
+
+	d.scriptsMutex.RLock()
+	defer d.scriptsMutex.RUnlock()
+
+	scriptList := make([]string, 0, len(d.scripts))
+	for _, script := range d.scripts {
+		scriptList = append(scriptList, script)
+	}
+
+	return scriptList
+}
+
+// loadScripts runs SCRIPT LOAD for each script on the given redis instance
+func (d *Discovery) loadScripts(hostPort string, scriptList []string) {
+
+	if len(scriptList) == 0 {
+		return
+	}
+
+	client, err := dial(hostPort, d.auth.Redis)
+
+	if err != nil {
+		log.Printf("ERROR: loadScripts: Unable to connect to %s => %v", hostPort, err)
+		return
+	}
+
+	defer client.Close()
+
+	for _, script := range scriptList {
+		if r := client.Cmd("script", "load", script); r.Err != nil {
+			log.Printf("ERROR: loadScripts: SCRIPT LOAD failed on %s => %v", hostPort, r.Err)
+		}
+	}
+
+	log.Printf("loadScripts: Loaded %d scripts on %s", len(scriptList), hostPort)
+}
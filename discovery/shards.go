@@ -0,0 +1,209 @@
+package discovery
+
+import (
+	"fmt"
+	"hargo/config"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// points of each shard on the consistent hash ring
+	ringReplicas = 160
+)
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// Shards spreads the keys across master groups, each one with its own master and slave pools.
+// Keys go by hash slot (slot ranges split evenly between the groups) or by consistent hashing,
+// the hash tag of a key deciding in both cases
+type Shards struct {
+	mutex  sync.RWMutex
+	shards []*Discovery
+
+	// hash_slot: slot => shard (-1 if unassigned)
+	slots []int
+	// consistent_hash: sorted ring
+	ring []ringPoint
+
+	// redis cluster: the slot map comes from the cluster itself
+	cluster     bool
+	cfg         *config.Config
+	refreshing  bool
+	lastRefresh time.Time
+}
+
+// NewShards starts a discovery for every master group. Without sharding there is a single group:
+// the one of the configured master
+func NewShards(cfg *config.Config) (*Shards, error) {
+
+	if len(cfg.Cluster.Nodes) > 0 {
+		return newClusterShards(cfg)
+	}
+
+	masterHostPort := fmt.Sprintf("%s:%d", cfg.MasterHost, cfg.MasterPort)
+
+	if len(cfg.Sharding.Masters) == 0 {
+		return newShards([]*Discovery{NewDiscovery(cfg, "", masterHostPort, nil)}, cfg.Sharding.Distribution)
+	}
+
+	// the sentinels are found through the configured master, they tell us the master of each group
+	sentinelHostPortList, err := findSentinels(masterHostPort, cfg.Auth.Redis)
+
+	if err != nil {
+		return nil, fmt.Errorf("Shards: %v", err)
+	}
+
+	if len(sentinelHostPortList) == 0 {
+		return nil, fmt.Errorf("Shards: no sentinel found through %s", masterHostPort)
+	}
+
+	shardList := make([]*Discovery, 0, len(cfg.Sharding.Masters))
+
+	for _, name := range cfg.Sharding.Masters {
+
+		shardMasterHostPort, err := masterAddrByName(sentinelHostPortList, name, cfg.Auth.Sentinel)
+
+		if err != nil {
+			return nil, fmt.Errorf("Shards: %v", err)
+		}
+
+		shardList = append(shardList, NewDiscovery(cfg, name, shardMasterHostPort, sentinelHostPortList))
+	}
+
+	return newShards(shardList, cfg.Sharding.Distribution)
+}
+
+func newShards(shardList []*Discovery, distribution string) (*Shards, error) {
+
+	s := &Shards{shards: shardList}
+
+	switch distribution {
+	case "", "hash_slot":
+
+		s.slots = make([]int, SlotCount)
+
+		for slot := range s.slots {
+			s.slots[slot] = slot * len(shardList) / SlotCount
+		}
+
+	case "consistent_hash":
+
+		s.ring = make([]ringPoint, 0, len(shardList)*ringReplicas)
+
+		for index, shard := range shardList {
+			for replica := 0; replica < ringReplicas; replica++ {
+				s.ring = append(s.ring, ringPoint{hash: ringHash(shard.Name() + "-" + strconv.Itoa(replica)), shard: index})
+			}
+		}
+
+		sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+
+	default:
+		return nil, fmt.Errorf("Shards: unknown distribution '%s'", distribution)
+	}
+
+	return s, nil
+}
+
+// Default returns the shard of the commands without keys
+func (s *Shards) Default() *Discovery {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.shards[0]
+}
+
+// All returns every shard
+func (s *Shards) All() []*Discovery {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.shards
+}
+
+func (s *Shards) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.shards)
+}
+
+// Clustered returns true when the shards are the ones of a redis cluster
+func (s *Shards) Clustered() bool {
+	return s.cluster
+}
+
+// ForKey returns the shard of a key
+func (s *Shards) ForKey(key string) *Discovery {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.forKey(key)
+}
+
+// forKey is ForKey with the mutex held
+func (s *Shards) forKey(key string) *Discovery {
+
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+
+	if s.slots != nil {
+
+		index := s.slots[HashSlot(key)]
+
+		// nobody serves the slot, redis will tell
+		if index < 0 {
+			return s.shards[0]
+		}
+
+		return s.shards[index]
+	}
+
+	hash := ringHash(HashTag(key))
+
+	index := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= hash })
+	if index == len(s.ring) {
+		index = 0
+	}
+
+	return s.shards[s.ring[index].shard]
+}
+
+// ForKeys returns the shard all the keys belong to (the default one without keys). It returns
+// false if the keys are spread across several shards, or several slots with redis cluster which
+// refuses those even on a single node
+func (s *Shards) ForKeys(keys []string) (*Discovery, bool) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if len(keys) == 0 {
+		return s.shards[0], true
+	}
+
+	if s.cluster {
+
+		slot := HashSlot(keys[0])
+
+		for _, key := range keys[1:] {
+			if HashSlot(key) != slot {
+				return nil, false
+			}
+		}
+	}
+
+	shard := s.forKey(keys[0])
+
+	for _, key := range keys[1:] {
+		if s.forKey(key) != shard {
+			return nil, false
+		}
+	}
+
+	return shard, true
+}
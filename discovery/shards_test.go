@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestShardsDistribution(t *testing.T) {
+
+	a, b := &Discovery{name: "a"}, &Discovery{name: "b"}
+
+	for _, distribution := range []string{"hash_slot", "consistent_hash"} {
+
+		s, err := newShards([]*Discovery{a, b}, distribution)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		used := make(map[*Discovery]int)
+		for i := 0; i < 1000; i++ {
+			used[s.ForKey("key:"+strconv.Itoa(i))]++
+		}
+
+		if len(used) != 2 {
+			t.Errorf("%s: keys on %d shards", distribution, len(used))
+		}
+
+		if _, ok := s.ForKeys([]string{"{x}1", "{x}2"}); !ok {
+			t.Errorf("%s: keys with the same hash tag split", distribution)
+		}
+	}
+
+	if _, err := newShards([]*Discovery{a}, "nope"); err == nil {
+		t.Error("unknown distribution accepted")
+	}
+}
+
+func TestShardsClusterSlots(t *testing.T) {
+
+	a := &Discovery{name: "a"}
+	s := &Shards{shards: []*Discovery{a, {name: "b"}}, slots: make([]int, SlotCount), cluster: true}
+
+	// "foo" and "bar" are on different slots of the same node
+	if _, ok := s.ForKeys([]string{"foo", "bar"}); ok {
+		t.Error("keys of two slots accepted")
+	}
+
+	if shard, ok := s.ForKeys([]string{"{foo}1", "{foo}2"}); !ok || shard != a {
+		t.Error("keys of the same slot refused")
+	}
+}
@@ -3,31 +3,55 @@ package discovery
 import (
 	"crypto/sha1"
 	"fmt"
-	redis "hargo/vendor/github.com/fzzy/radix/redis"
+	"hargo/config"
 	"io"
 	"log"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 func (d *Discovery) updateSentinels() {
 
-	if d.masterHostPort == "" {
+	masterHostPort := d.MasterHostPort()
+
+	if masterHostPort == "" {
 		log.Printf("updateSentinels: ERROR: No master available. This should have not happened!\n")
 		return
 	}
 
-	log.Printf("updateSentinels: Connecting to master at %s\n", d.masterHostPort)
+	sentinelHostPortList, err := findSentinels(masterHostPort, d.auth.Redis)
+
+	if err != nil {
+		log.Fatalf("updateSentinels: %v", err)
+	}
+
+	if sentinelHostPortList == nil {
+		return
+	}
+
+	// we update the reference
+	d.sentinelHostPortList = sentinelHostPortList
+}
+
+// findSentinels listens to the sentinel hellos on the master for a few seconds and returns the sentinels
+// that showed up (nil if the channel can't be subscribed to)
+func findSentinels(masterHostPort string, credentials config.Credentials) ([]string, error) {
+
+	log.Printf("updateSentinels: Connecting to master at %s\n", masterHostPort)
 
 	// we connect to the master
-	master, err := redis.DialTimeout("tcp", d.masterHostPort, time.Duration(5)*time.Second)
+	master, err := dial(masterHostPort, credentials)
 
 	if err != nil {
-		log.Fatalf("updateSentinels: Unable to connect to Redis master %s => %v", d.masterHostPort, err)
+		return nil, fmt.Errorf("Unable to connect to Redis master %s => %v", masterHostPort, err)
 	}
 
+	// we close the connection to the master
+	defer master.Close()
+
 	// we subscribe to the __sentinel__:hello channel
 	log.Printf("updateSentinels: Subscribing to the sentinel hello channel\n")
 
@@ -35,7 +59,7 @@ func (d *Discovery) updateSentinels() {
 
 	if r.Err != nil {
 		log.Printf("ERROR: updateSentinels: subscribe call failed %v", r.Err)
-		return
+		return nil, nil
 	}
 
 	cutOffTime := time.Now().Add(time.Second * time.Duration(4))
@@ -77,11 +101,39 @@ func (d *Discovery) updateSentinels() {
 
 	log.Printf("Retrieved %d sentinels", len(sentinelHostPortList))
 
-	// we close the connection to the master
-	master.Close()
+	return sentinelHostPortList, nil
+}
 
-	// we update the reference
-	d.sentinelHostPortList = sentinelHostPortList
+// masterAddrByName asks the sentinels for the current master of a group
+func masterAddrByName(sentinelHostPortList []string, name string, credentials config.Credentials) (string, error) {
+
+	for _, sentinelHostPort := range sentinelHostPortList {
+
+		sentinel, err := dial(sentinelHostPort, credentials)
+
+		if err != nil {
+			log.Printf("ERROR: Unable to connect to sentinel %s => %v", sentinelHostPort, err)
+			continue
+		}
+
+		r := sentinel.Cmd("sentinel", "get-master-addr-by-name", name)
+		sentinel.Close()
+
+		if r.Err != nil {
+			log.Printf("ERROR: Sentinel get-master-addr-by-name call failed for %s %v", name, r.Err)
+			continue
+		}
+
+		addr, err := r.List()
+
+		if err != nil || len(addr) != 2 {
+			return "", fmt.Errorf("Sentinel %s doesn't know the master group '%s'", sentinelHostPort, name)
+		}
+
+		return addr[0] + ":" + addr[1], nil
+	}
+
+	return "", fmt.Errorf("No sentinel could tell the master of the group '%s'", name)
 }
 
 func (d *Discovery) updateMasterSlaves() {
@@ -95,7 +147,7 @@ func (d *Discovery) updateMasterSlaves() {
 
 	log.Printf("updateMasterSlaves: Connecting to randomly selected sentinel at %s\n", sentinelHostPort)
 
-	sentinel, err := redis.DialTimeout("tcp", sentinelHostPort, time.Duration(5)*time.Second)
+	sentinel, err := dial(sentinelHostPort, d.auth.Sentinel)
 
 	if err != nil {
 		log.Printf("ERROR: Unable to connect to sentinel %s => %v", sentinelHostPort, err)
@@ -110,17 +162,30 @@ func (d *Discovery) updateMasterSlaves() {
 	}
 
 	if len(r.Elems) == 0 {
-		log.Printf("ERROR: Sentinel reported no masters", r.Err)
+		log.Printf("ERROR: Sentinel reported no masters")
 		return
 	}
 
-	// we pick the first
-	r = r.Elems[0]
+	// we pick ours (the first one if we don't have a name)
+	var masterInfo map[string]string
 
-	masterInfo, err := r.Hash()
+	for _, masterReply := range r.Elems {
 
-	if err != nil {
-		log.Printf("ERROR: Malformed Sentinel masters reply", err)
+		info, err := masterReply.Hash()
+
+		if err != nil {
+			log.Printf("ERROR: Malformed Sentinel masters reply %v", err)
+			return
+		}
+
+		if d.name == "" || info["name"] == d.name {
+			masterInfo = info
+			break
+		}
+	}
+
+	if masterInfo == nil {
+		log.Printf("ERROR: Sentinel doesn't monitor the master group '%s'", d.name)
 		return
 	}
 
@@ -129,28 +194,20 @@ func (d *Discovery) updateMasterSlaves() {
 
 	// we update the master reference (if there was a change)
 
-	if d.MasterSignature() != hash(masterHostPort) {
-
-		log.Printf("Master Signature mismatch, updating '%s' to %s'", d.MasterSignature(), hash(masterHostPort))
-
-		d.masterMutex.Lock()
-		d.masterSignature = hash(masterHostPort)
-		d.masterMutex.Unlock()
-
-		// we enqueue the new connection wrappers
-		for i := 0; i < conPerEndpoint; i++ {
-			d.masterCh <- NewConnWrapper(masterHostPort, d.masterSignature)
-		}
-	}
+	d.setMaster(masterHostPort)
 
 	// we get the slaves
 	r = sentinel.Cmd("sentinel", "slaves", masterInfo["name"])
 
-	if len(r.Elems) == 0 {
-		log.Printf("ERROR: Sentinel reported no slaves for %s", masterInfo["name"], r.Err)
+	if r.Err != nil {
+		log.Printf("ERROR: Sentinel slaves call failed for %s %v", masterInfo["name"], r.Err)
 		return
 	}
 
+	if len(r.Elems) == 0 {
+		log.Printf("Sentinel reported no slaves for %s", masterInfo["name"])
+	}
+
 	slaveHostPortList := make([]string, 0)
 
 	for index, slaveReply := range r.Elems {
@@ -158,39 +215,202 @@ func (d *Discovery) updateMasterSlaves() {
 		slaveInfo, err := slaveReply.Hash()
 
 		if err != nil {
-			log.Printf("ERROR: Malformed Sentinel slaves reply", err)
+			log.Printf("ERROR: Malformed Sentinel slaves reply %v", err)
 			return
 		}
 
 		slaveHostPort := fmt.Sprintf("%s:%s", slaveInfo["ip"], slaveInfo["port"])
 
-		log.Printf("Slave %s has flags: %s\n", slaveHostPort, slaveInfo["flags"])
+		log.Printf("Analyzing slave #%d => %s", index, slaveHostPort)
 
-		slaveHostPortList = append(slaveHostPortList, slaveHostPort)
+		// sentinel knows better than us which slaves are unfit
+		if reason := slaveExclusion(slaveInfo); reason != "" {
+			log.Printf("Slave %s excluded from the read pool: %s\n", slaveHostPort, reason)
+			continue
+		}
 
-		log.Printf("Analyzing slave #%d => %s", index, slaveHostPort)
+		slaveHostPortList = append(slaveHostPortList, slaveHostPort)
 	}
 	// we sort the array (to help with hashing)
 	sort.Strings(slaveHostPortList)
 
 	// we update the slave references
 
-	if d.SlavesSignature() != hash(slaveHostPortList...) {
+	if d.SlavesSignature() != slavesHash(slaveHostPortList) {
+
+		log.Printf("Slaves Signature mismatch, updating '%s' to '%s'", d.SlavesSignature(), slavesHash(slaveHostPortList))
+
+		d.updateSlaves(slaveHostPortList)
+	}
+
+}
+
+// setMaster switches the master pool to masterHostPort if it changed
+func (d *Discovery) setMaster(masterHostPort string) {
+
+	if d.MasterSignature() == hash(masterHostPort) {
+		return
+	}
+
+	log.Printf("Master Signature mismatch, updating '%s' to %s'", d.MasterSignature(), hash(masterHostPort))
+
+	d.masterMutex.Lock()
+	d.masterSignature = hash(masterHostPort)
+	d.masterHostPort = masterHostPort
+	d.masterMutex.Unlock()
+
+	// we enqueue the new connection wrappers
+	for i := 0; i < conPerEndpoint; i++ {
+		d.masterCh <- NewConnWrapper(masterHostPort, d.masterSignature, d.auth.Redis)
+	}
+
+	// the new master may run a different redis version (or modules)
+	d.updateCommands(masterHostPort)
+
+	// and doesn't have the scripts in its cache
+	d.loadScripts(masterHostPort, d.scriptList())
+}
 
-		log.Printf("Slaves Signature mismatch, updating '%s' to '%s'", d.SlavesSignature(), hash(slaveHostPortList...))
+// updateSlaves replaces the slave endpoints: the ones still there are kept with their connections
+func (d *Discovery) updateSlaves(slaveHostPortList []string) {
 
-		d.slavesMutex.Lock()
-		d.slavesSignature = hash(slaveHostPortList...)
-		d.slavesMutex.Unlock()
+	currentMap := make(map[string]*Endpoint)
+	for _, endpoint := range d.Slaves() {
+		currentMap[endpoint.HostPort()] = endpoint
+	}
+
+	slaves := make([]*Endpoint, 0, len(slaveHostPortList))
+
+	for _, slaveHostPort := range slaveHostPortList {
 
-		// we enqueue the new connection wrappers
-		for i := 0; i < conPerEndpoint; i++ {
-			for _, slaveHostPort := range slaveHostPortList {
-				d.slavesCh <- NewConnWrapper(slaveHostPort, d.slavesSignature)
-			}
+		if endpoint, ok := currentMap[slaveHostPort]; ok {
+			slaves = append(slaves, endpoint)
+			delete(currentMap, slaveHostPort)
+			continue
 		}
+
+		slaves = append(slaves, newEndpoint(slaveHostPort, d.localityOf(slaveHostPort), d.auth.Redis, d.cluster))
+
+		// the scripts must be there before the slave serves EVALSHA_RO
+		d.loadScripts(slaveHostPort, d.scriptList())
+	}
+
+	d.slavesMutex.Lock()
+	d.slaves = slaves
+	d.slavesSignature = slavesHash(slaveHostPortList)
+	d.slavesMutex.Unlock()
+
+	// the slaves left are gone
+	for _, endpoint := range currentMap {
+		log.Printf("updateSlaves: Removing slave %s", endpoint.HostPort())
+		endpoint.retire()
+	}
+}
+
+// checkReplication takes the slaves lagging behind the master out of the read rotation
+func (d *Discovery) checkReplication() {
+
+	slaves := d.Slaves()
+
+	if len(slaves) == 0 {
+		return
+	}
+
+	masterOffset := d.masterReplicationOffset()
+
+	for _, endpoint := range slaves {
+
+		// a slave coming back may have restarted with an empty script cache
+		if endpoint.checkReplication(masterOffset, d.replication.MaxLagBytes, d.replication.MaxLastIOSeconds) {
+			d.loadScripts(endpoint.HostPort(), d.scriptList())
+		}
+	}
+}
+
+// masterReplicationOffset returns the master_repl_offset of the master (-1 if unknown)
+func (d *Discovery) masterReplicationOffset() int64 {
+
+	d.masterMonitorMutex.Lock()
+	defer d.masterMonitorMutex.Unlock()
+
+	masterHostPort := d.MasterHostPort()
+
+	// the master changed
+	if d.masterMonitor != nil && d.masterMonitorHostPort != masterHostPort {
+		d.masterMonitor.Close()
+		d.masterMonitor = nil
+	}
+
+	if d.masterMonitor == nil {
+
+		monitor, err := dial(masterHostPort, d.auth.Redis)
+
+		if err != nil {
+			log.Printf("ERROR: checkReplication: Unable to connect to master %s => %v", masterHostPort, err)
+			return -1
+		}
+
+		d.masterMonitor = monitor
+		d.masterMonitorHostPort = masterHostPort
+	}
+
+	info, err := readInfo(d.masterMonitor, "replication")
+
+	if err != nil {
+		log.Printf("ERROR: checkReplication: INFO replication failed on master %s => %v", masterHostPort, err)
+		d.masterMonitor.Close()
+		d.masterMonitor = nil
+		return -1
+	}
+
+	masterOffset, err := strconv.ParseInt(info["master_repl_offset"], 10, 64)
+
+	if err != nil {
+		return -1
+	}
+
+	return masterOffset
+}
+
+// slaveExclusion returns why a slave reported by SENTINEL SLAVES must not serve reads ("" if it can)
+func slaveExclusion(slaveInfo map[string]string) string {
+
+	for _, flag := range strings.Split(slaveInfo["flags"], ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return "flagged " + flag
+		}
+	}
+
+	if status, ok := slaveInfo["master-link-status"]; ok && status != "ok" {
+		return "master link is " + status
+	}
+
+	if downTime, err := strconv.ParseInt(slaveInfo["master-link-down-time"], 10, 64); err == nil && downTime > 0 {
+		return fmt.Sprintf("master link down for %d ms", downTime)
+	}
+
+	// priority 0 slaves are not meant to be used
+	priority, ok := slaveInfo["slave-priority"]
+	if !ok {
+		priority, ok = slaveInfo["replica-priority"]
+	}
+
+	if ok && priority == "0" {
+		return "priority is 0"
+	}
+
+	return ""
+}
+
+// slavesHash returns the slaves signature ("" when there are no slaves)
+func slavesHash(slaveHostPortList []string) string {
+
+	if len(slaveHostPortList) == 0 {
+		return ""
 	}
 
+	return hash(slaveHostPortList...)
 }
 
 func hash(list ...string) string {
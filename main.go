@@ -1,21 +1,50 @@
 package main
 
 import (
+	"flag"
+	"hargo/config"
 	"hargo/discovery"
 	"hargo/session"
 	"log"
 	"net"
 	"runtime"
+	"strconv"
 )
 
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	configPath := flag.String("config", "", "path to the JSON configuration file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Unable to load the configuration because: %v", err)
+	}
+
+	// master host and port can still be given on the command line
+	if flag.NArg() > 0 {
+		cfg.MasterHost = flag.Arg(0)
+	}
+
+	if flag.NArg() > 1 {
+		if masterPort, err := strconv.Atoi(flag.Arg(1)); err == nil {
+			cfg.MasterPort = masterPort
+		}
+	}
+
 	// plumbing
-	discovery := discovery.NewDiscovery()
+	shards, err := discovery.NewShards(cfg)
+	if err != nil {
+		log.Fatalf("Unable to start the discovery because: %v", err)
+	}
+
 	cache := session.NewCache()
-	manager := session.NewManager(discovery, cache)
+	manager, err := session.NewManager(shards, cache, cfg)
+	if err != nil {
+		log.Fatalf("Unable to start the session manager because: %v", err)
+	}
 
 	// we start a tcp server on port 36379
 	ln, err := net.Listen("tcp", ":36379")
@@ -0,0 +1,241 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"hargo/discovery"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockingTimeout returns how long a blocking command may wait for data (0 is forever). It returns false
+// if the request doesn't block (i.e. XREAD without BLOCK) or if its timeout is invalid: redis replies at once
+func blockingTimeout(req *request) (time.Duration, bool) {
+
+	args := req.args
+
+	switch req.name {
+	case "blpop", "brpop", "brpoplpush", "blmove", "bzpopmin", "bzpopmax":
+		// BLPOP key [key ...] timeout
+		if len(args) < 3 {
+			return 0, false
+		}
+		return parseSeconds(args[len(args)-1])
+
+	case "blmpop", "bzmpop":
+		// BLMPOP timeout numkeys key [key ...] ...
+		if len(args) < 2 {
+			return 0, false
+		}
+		return parseSeconds(args[1])
+
+	case "wait":
+		// WAIT numreplicas timeout
+		if len(args) != 3 {
+			return 0, false
+		}
+		return parseMilliseconds(args[2])
+
+	case "waitaof":
+		// WAITAOF numlocal numreplicas timeout
+		if len(args) != 4 {
+			return 0, false
+		}
+		return parseMilliseconds(args[3])
+
+	case "xread", "xreadgroup":
+		// XREAD ... [BLOCK milliseconds] ... STREAMS key [key ...] id [id ...]
+		for k := 1; k < len(args)-1; k++ {
+
+			switch strings.ToLower(args[k]) {
+			case "streams":
+				return 0, false
+
+			case "block":
+				return parseMilliseconds(args[k+1])
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// parseSeconds reads a timeout in seconds (decimals allowed, as redis does)
+func parseSeconds(arg string) (time.Duration, bool) {
+
+	seconds, err := strconv.ParseFloat(arg, 64)
+
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// parseMilliseconds reads a timeout in milliseconds
+func parseMilliseconds(arg string) (time.Duration, bool) {
+
+	ms, err := strconv.ParseInt(arg, 10, 64)
+
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// waiting returns true for the commands waiting for the replication of the writes made before them
+// on the same connection: they can't go on a connection of their own
+func waiting(req *request) bool {
+	return req.name == "wait" || req.name == "waitaof"
+}
+
+// batchTimeout returns how long to wait for each reply of a batch: longer than the usual delay when
+// it carries WAIT or WAITAOF (0 waits forever)
+func batchTimeout(batch []*request) time.Duration {
+
+	readTimeout := replyTimeout
+
+	for _, req := range batch {
+
+		if !waiting(req) {
+			continue
+		}
+
+		timeout, ok := blockingTimeout(req)
+
+		if !ok {
+			continue
+		}
+
+		if timeout == 0 {
+			return 0
+		}
+
+		if timeout+replyTimeout > readTimeout {
+			readTimeout = timeout + replyTimeout
+		}
+	}
+
+	return readTimeout
+}
+
+// block sends a blocking command to the master on the blocking connection of the session: the pooled
+// ones are not kept busy and the reply is awaited as long as the command itself may block
+func (c *CommandSession) block(req *request, timeout time.Duration, out *bytes.Buffer) {
+
+	if c.manager.blockers != nil {
+
+		select {
+		case c.manager.blockers <- struct{}{}:
+			defer func() { <-c.manager.blockers }()
+		default:
+			writeError(out, newReplyError("ERR", "Too many blocked clients on the proxy"))
+			return
+		}
+	}
+
+	// the connection is kept for the next blocking command, unless the master changed
+	if c.blocker != nil && c.blocker.Signature() != c.discov.MasterSignature() {
+		c.closeBlocker()
+	}
+
+	if c.blocker == nil {
+		c.blocker = c.discov.NewMasterConn()
+	}
+
+	redis := c.blocker
+
+	if !redis.IsConnected() {
+		c.closeBlocker()
+		writeError(out, sendError(fmt.Errorf("no connection to the master %s", redis.HostPort())))
+		return
+	}
+
+	if err := c.switchProtocol(redis); err != nil {
+		writeError(out, err)
+		return
+	}
+
+	if err := c.switchDB(redis); err != nil {
+		writeError(out, err)
+		return
+	}
+
+	// redis replies once the timeout expires, we give it the usual delay on top
+	readTimeout := time.Duration(0)
+	if timeout > 0 {
+		readTimeout = timeout + replyTimeout
+	}
+
+	if err := c.send(redis, []*request{req}, out); err != nil {
+		log.Printf("Blocking command '%s' failed because: %v", req.name, err)
+		return
+	}
+
+	stop := c.watchClient(redis)
+	err := c.receive(redis, []*request{req}, out, readTimeout)
+	stop()
+
+	if err != nil {
+		log.Printf("Blocking command '%s' failed because: %v", req.name, err)
+	}
+}
+
+// watchClient reads the client while it is blocked: a client going away interrupts the blocking
+// command, redis then drops it without serving it. What the client sends meanwhile is kept for later.
+// The returned function stops the watch
+func (c *CommandSession) watchClient(redis *discovery.ConnWrapper) func() {
+
+	done := make(chan struct{})
+	received := make([]byte, 0)
+
+	go func() {
+
+		defer close(done)
+
+		buf := make([]byte, 4096)
+
+		for {
+
+			read, err := c.client.Read(buf)
+			received = append(received, buf[0:read]...)
+
+			if err == nil && len(received) <= maxRequestSize {
+				continue
+			}
+
+			// our own deadline, the command is over
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+
+			log.Printf("Client left while blocked")
+			redis.Interrupt()
+			return
+		}
+	}()
+
+	return func() {
+
+		c.client.SetReadDeadline(time.Now())
+		<-done
+		c.client.SetReadDeadline(time.Time{})
+
+		c.pendingInput = append(c.pendingInput, received...)
+	}
+}
+
+// closeBlocker closes the blocking connection of the session
+func (c *CommandSession) closeBlocker() {
+
+	if c.blocker == nil {
+		return
+	}
+
+	c.blocker.Destroy()
+	c.blocker = nil
+}
@@ -0,0 +1,54 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockingTimeout(t *testing.T) {
+
+	tests := []struct {
+		args    []string
+		timeout time.Duration
+		ok      bool
+	}{
+		{[]string{"BLPOP", "a", "b", "1.5"}, 1500 * time.Millisecond, true},
+		{[]string{"BLPOP", "a", "0"}, 0, true},
+		{[]string{"BLPOP", "a", "x"}, 0, false},
+		{[]string{"BLMPOP", "2", "1", "a", "LEFT"}, 2 * time.Second, true},
+		{[]string{"XREAD", "COUNT", "2", "BLOCK", "250", "STREAMS", "s", "$"}, 250 * time.Millisecond, true},
+		{[]string{"XREAD", "STREAMS", "block", "$"}, 0, false},
+		{[]string{"WAIT", "1", "100"}, 100 * time.Millisecond, true},
+		{[]string{"WAITAOF", "1", "0", "0"}, 0, true},
+		{[]string{"GET", "a"}, 0, false},
+	}
+
+	for _, test := range tests {
+
+		req := &request{args: test.args, name: strings.ToLower(test.args[0])}
+
+		if timeout, ok := blockingTimeout(req); timeout != test.timeout || ok != test.ok {
+			t.Errorf("%v: got %v %v, want %v %v", test.args, timeout, ok, test.timeout, test.ok)
+		}
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+
+	get := &request{args: []string{"GET", "a"}, name: "get"}
+	wait := &request{args: []string{"WAIT", "1", "2000"}, name: "wait"}
+	forever := &request{args: []string{"WAIT", "1", "0"}, name: "wait"}
+
+	if got := batchTimeout([]*request{get}); got != replyTimeout {
+		t.Errorf("plain batch: %v", got)
+	}
+
+	if got := batchTimeout([]*request{get, wait}); got != 2*time.Second+replyTimeout {
+		t.Errorf("WAIT batch: %v", got)
+	}
+
+	if got := batchTimeout([]*request{wait, forever}); got != 0 {
+		t.Errorf("WAIT 0 batch: %v", got)
+	}
+}
@@ -44,6 +44,17 @@ func (c *Cache) Get(command string) []byte {
 	return c.data[command]
 }
 
+// Clear drops every cached reply (i.e. after SWAPDB)
+func (c *Cache) Clear() {
+
+	// write lock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.data = make(map[string][]byte)
+	c.dataLastUpdated = make(map[string]time.Time)
+}
+
 func (c *Cache) cleanupCache() {
 
 	oneSecondAgo := time.Now().Add(-time.Second)
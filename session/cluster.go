@@ -0,0 +1,157 @@
+package session
+
+import (
+	"bytes"
+	"hargo/discovery"
+	"strconv"
+	"strings"
+)
+
+const (
+	// a request is not chased around the cluster forever
+	maxRedirections = 5
+)
+
+// redirection is a -MOVED or -ASK error of redis cluster: the slot of the key is served by another node,
+// for good (MOVED) or while it is being migrated (ASK)
+type redirection struct {
+	ask      bool
+	slot     int
+	hostPort string
+}
+
+// isRedirection returns true if the reply is a -MOVED or -ASK error
+func isRedirection(reply []byte) bool {
+	return bytes.HasPrefix(reply, []byte("-MOVED ")) || bytes.HasPrefix(reply, []byte("-ASK "))
+}
+
+// parseRedirection reads a -MOVED <slot> <host:port> or -ASK <slot> <host:port> error reply
+func parseRedirection(reply []byte) (*redirection, bool) {
+
+	if !isRedirection(reply) {
+		return nil, false
+	}
+
+	fieldList := strings.Fields(string(reply[1:]))
+
+	if len(fieldList) != 3 {
+		return nil, false
+	}
+
+	slot, err := strconv.Atoi(fieldList[1])
+
+	if err != nil {
+		return nil, false
+	}
+
+	return &redirection{ask: fieldList[0] == "ASK", slot: slot, hostPort: fieldList[2]}, true
+}
+
+// followRedirections runs again the requests of the batch that redis cluster redirected, their replies
+// take the place of the redirections in out
+func (c *CommandSession) followRedirections(batch []*request, out *bytes.Buffer) {
+
+	// from the last one so that the offsets of the others stay valid
+	for i := len(batch) - 1; i >= 0; i-- {
+
+		req := batch[i]
+
+		if req.replyEnd <= req.replyStart || req.replyEnd > out.Len() {
+			continue
+		}
+
+		r, ok := parseRedirection(out.Bytes()[req.replyStart:req.replyEnd])
+
+		if !ok {
+			continue
+		}
+
+		start, end := req.replyStart, req.replyEnd
+		reply := c.redirect(req, r)
+
+		tail := append([]byte(nil), out.Bytes()[end:]...)
+		out.Truncate(start)
+		out.Write(reply)
+		out.Write(tail)
+
+		// the offsets follow the replies they point to
+		req.replyStart, req.replyEnd = start, start+len(reply)
+
+		for _, next := range batch[i+1:] {
+			next.replyStart += len(reply) - (end - start)
+			next.replyEnd += len(reply) - (end - start)
+		}
+	}
+}
+
+// redirect sends the request where redis cluster told and returns its reply. MOVED updates the slot map,
+// ASK is a one shot: the request goes after ASKING to the importing node
+func (c *CommandSession) redirect(req *request, r *redirection) []byte {
+
+	shards := c.manager.shards
+
+	for hop := 0; hop < maxRedirections; hop++ {
+
+		var shard *discovery.Discovery
+
+		if r.ask {
+			shard = shards.ByMaster(r.hostPort)
+		} else {
+			shard = shards.Moved(r.slot, r.hostPort)
+		}
+
+		batch := []*request{req}
+
+		if r.ask {
+			asking := &request{args: []string{"ASKING"}}
+			asking.raw = formatCommand(asking.args)
+			batch = []*request{asking, req}
+		}
+
+		// a node we don't know yet gets a connection of its own
+		var redis *discovery.ConnWrapper
+		var release func()
+
+		if shard != nil {
+			redis, release, _ = checkoutFrom(shard, true)
+		} else {
+			conn := shards.NewConn(r.hostPort)
+			redis, release = conn, func() { conn.Destroy() }
+		}
+
+		replyOut := &bytes.Buffer{}
+
+		err := c.switchProtocol(redis)
+
+		if err == nil {
+			err = c.switchDB(redis)
+		}
+
+		if err == nil {
+			err = c.roundTrip(redis, batch, replyOut)
+		}
+
+		release()
+
+		if err != nil {
+			errOut := &bytes.Buffer{}
+			writeError(errOut, err)
+			return errOut.Bytes()
+		}
+
+		reply := replyOut.Bytes()[req.replyStart:req.replyEnd]
+
+		next, ok := parseRedirection(reply)
+
+		if !ok {
+			return reply
+		}
+
+		r = next
+	}
+
+	errOut := &bytes.Buffer{}
+	writeError(errOut, newReplyError("ERR", "Too many cluster redirections for '"+req.name+"'"))
+
+	return errOut.Bytes()
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRedirection(t *testing.T) {
+
+	tests := []struct {
+		reply string
+		want  *redirection
+	}{
+		{"-MOVED 3999 127.0.0.1:6381\r\n", &redirection{slot: 3999, hostPort: "127.0.0.1:6381"}},
+		{"-ASK 12 10.0.0.1:7000\r\n", &redirection{ask: true, slot: 12, hostPort: "10.0.0.1:7000"}},
+		{"-MOVED x 10.0.0.1:7000\r\n", nil},
+		{"-ERR nope\r\n", nil},
+		{"+MOVED 1 a:1\r\n", nil},
+	}
+
+	for _, test := range tests {
+
+		got, ok := parseRedirection([]byte(test.reply))
+
+		if test.want == nil {
+			if ok {
+				t.Errorf("%q: not a redirection, got %+v", test.reply, got)
+			}
+			continue
+		}
+
+		if !ok || *got != *test.want {
+			t.Errorf("%q: got %+v, want %+v", test.reply, got, test.want)
+		}
+	}
+}
+
+func TestFollowRedirectionsOffsets(t *testing.T) {
+
+	// no redirection: the batch and its offsets are left alone
+	batch := []*request{{replyStart: 0, replyEnd: 5}, {replyStart: 5, replyEnd: 12}}
+	out := bytes.NewBufferString("+OK\r\n$1\r\nA\r\n")
+
+	(&CommandSession{}).followRedirections(batch, out)
+
+	if out.String() != "+OK\r\n$1\r\nA\r\n" || batch[1].replyStart != 5 || batch[1].replyEnd != 12 {
+		t.Fatalf("%q %+v", out.String(), batch[1])
+	}
+}
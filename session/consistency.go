@@ -0,0 +1,130 @@
+package session
+
+import (
+	"hargo/command"
+	"time"
+)
+
+type consistencyMode int
+
+const (
+	consistencyOff consistencyMode = iota
+	// after a write every read of the session goes to the master
+	consistencySession
+	// after a write only the reads of the written keys go to the master
+	consistencyKeys
+)
+
+var consistencyModeNames = map[string]consistencyMode{
+	"":        consistencyOff,
+	"off":     consistencyOff,
+	"session": consistencySession,
+	"keys":    consistencyKeys,
+}
+
+const (
+	// written keys we remember, past this (once the expired ones are gone) the session mode takes over
+	maxTrackedKeys = 1024
+)
+
+// scriptWriteCommands run scripts that may write, redis doesn't give them the write flag
+var scriptWriteCommands = map[string]bool{
+	"eval":    true,
+	"evalsha": true,
+	"fcall":   true,
+}
+
+// readYourWrites keeps track of the writes of a session so that its following reads
+// don't hit a slave (or the cache) that hasn't seen them yet
+type readYourWrites struct {
+	mode   consistencyMode
+	window time.Duration
+
+	// until when reads go to the master (in keys mode, too many keys were written)
+	sessionUntil time.Time
+	keysUntil    map[string]time.Time
+}
+
+func newReadYourWrites(mode consistencyMode, window time.Duration) *readYourWrites {
+
+	r := &readYourWrites{mode: mode, window: window}
+
+	if mode == consistencyKeys {
+		r.keysUntil = make(map[string]time.Time)
+	}
+
+	return r
+}
+
+// wrote records a request sent to the master
+func (r *readYourWrites) wrote(req *request) {
+
+	if r.mode == consistencyOff || req.info == nil || !(req.info.Has(command.Write) || scriptWriteCommands[req.name]) {
+		return
+	}
+
+	until := time.Now().Add(r.window)
+
+	// a write without keys (FLUSHALL, SWAPDB...) may have changed any key
+	if r.mode == consistencySession || len(req.keys) == 0 {
+		r.sessionUntil = until
+		return
+	}
+
+	if len(r.keysUntil)+len(req.keys) > maxTrackedKeys {
+		r.cleanup()
+	}
+
+	// too many keys to follow: every read goes to the master until the window is over, which covers
+	// the keys tracked so far
+	if len(r.keysUntil)+len(req.keys) > maxTrackedKeys {
+		r.sessionUntil = until
+		r.keysUntil = make(map[string]time.Time)
+		return
+	}
+
+	for _, key := range req.keys {
+		r.keysUntil[key] = until
+	}
+}
+
+// mustReadMaster returns true if the request reads something the session wrote recently
+func (r *readYourWrites) mustReadMaster(req *request) bool {
+
+	switch r.mode {
+	case consistencySession:
+		return time.Now().Before(r.sessionUntil)
+
+	case consistencyKeys:
+
+		now := time.Now()
+
+		if now.Before(r.sessionUntil) {
+			return true
+		}
+
+		if len(r.keysUntil) == 0 {
+			return false
+		}
+
+		for _, key := range req.keys {
+			if until, ok := r.keysUntil[key]; ok && now.Before(until) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// cleanup forgets the keys whose window is over
+func (r *readYourWrites) cleanup() {
+
+	now := time.Now()
+
+	for key, until := range r.keysUntil {
+		if !now.Before(until) {
+			delete(r.keysUntil, key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package session
+
+import (
+	"hargo/command"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadYourWritesKeys(t *testing.T) {
+
+	r := newReadYourWrites(consistencyKeys, time.Minute)
+	write := &command.Info{Flags: command.Write}
+
+	r.wrote(&request{info: write, keys: []string{"a"}})
+
+	if !r.mustReadMaster(&request{keys: []string{"a"}}) || r.mustReadMaster(&request{keys: []string{"b"}}) {
+		t.Fatal("only the written key goes to the master")
+	}
+}
+
+func TestReadYourWritesTrackedKeysCap(t *testing.T) {
+
+	r := newReadYourWrites(consistencyKeys, time.Minute)
+	write := &command.Info{Flags: command.Write}
+
+	for i := 0; i < 5*maxTrackedKeys; i++ {
+		r.wrote(&request{info: write, keys: []string{strconv.Itoa(i)}})
+	}
+
+	if len(r.keysUntil) > maxTrackedKeys {
+		t.Fatalf("%d keys tracked", len(r.keysUntil))
+	}
+
+	// past the limit every read goes to the master
+	if !r.mustReadMaster(&request{keys: []string{"0"}}) || !r.mustReadMaster(&request{keys: []string{"other"}}) {
+		t.Fatal("expected the session mode")
+	}
+}
+
+func TestReadYourWritesScripts(t *testing.T) {
+
+	for _, mode := range []consistencyMode{consistencySession, consistencyKeys} {
+
+		r := newReadYourWrites(mode, time.Minute)
+
+		r.wrote(newTestRequest("EVAL", "redis.call('set', KEYS[1], 1)", "1", "a"))
+
+		if !r.mustReadMaster(newTestRequest("GET", "a")) {
+			t.Errorf("mode %d: the script write is not seen", mode)
+		}
+
+		r = newReadYourWrites(mode, time.Minute)
+
+		r.wrote(newTestRequest("EVAL_RO", "return 1", "1", "a"))
+
+		if r.mustReadMaster(newTestRequest("GET", "a")) {
+			t.Errorf("mode %d: a read-only script counts as a write", mode)
+		}
+	}
+}
+
+func TestReadYourWritesKeylessWrites(t *testing.T) {
+
+	r := newReadYourWrites(consistencyKeys, time.Minute)
+
+	r.wrote(newTestRequest("FLUSHALL"))
+
+	if !r.mustReadMaster(newTestRequest("GET", "anything")) {
+		t.Fatal("a write without keys must send every read to the master")
+	}
+}
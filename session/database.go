@@ -0,0 +1,119 @@
+package session
+
+import (
+	"bytes"
+	"hargo/discovery"
+	"strconv"
+	"strings"
+)
+
+// selectDB forwards SELECT to the master and keeps track of the database the client chose.
+// The pooled connections are switched to it lazily, when the session checks them out
+func (c *CommandSession) selectDB(req *request, out *bytes.Buffer) {
+
+	// the database would only change once EXEC runs, on the pinned connection alone
+	if c.tx.inMulti || c.tx.deferred {
+		writeError(out, newReplyError("ERR", "SELECT inside MULTI is not supported by the proxy"))
+		return
+	}
+
+	if len(req.args) != 2 {
+		writeError(out, newReplyError("ERR", "wrong number of arguments for 'select' command"))
+		return
+	}
+
+	db, err := strconv.Atoi(req.args[1])
+
+	if err != nil || db < 0 {
+		writeError(out, newReplyError("ERR", "value is not an integer or out of range"))
+		return
+	}
+
+	start := out.Len()
+
+	c.isHA = true
+
+	redis, release := c.checkout()
+	defer release()
+
+	// redis checks the database exists
+	if err := c.roundTrip(redis, []*request{req}, out); err != nil {
+		return
+	}
+
+	if out.Len() > start && out.Bytes()[start] != '-' {
+		c.db = db
+		redis.SetDB(db)
+	}
+}
+
+// switchDB makes the connection use the same database as the client
+func (c *CommandSession) switchDB(redis *discovery.ConnWrapper) error {
+
+	if redis.DB() == c.db {
+		return nil
+	}
+
+	selectReq := &request{args: []string{"SELECT", strconv.Itoa(c.db)}}
+	selectReq.raw = formatCommand(selectReq.args)
+
+	selectOut := &bytes.Buffer{}
+
+	if err := c.roundTrip(redis, []*request{selectReq}, selectOut); err != nil {
+		return err
+	}
+
+	if selectOut.Len() > 0 && selectOut.Bytes()[0] == '-' {
+		// we don't know where the connection stands anymore
+		redis.SetDB(-1)
+		return newReplyError("ERR", "Unable to select database "+strconv.Itoa(c.db)+" on the redis connection")
+	}
+
+	redis.SetDB(c.db)
+
+	return nil
+}
+
+// reset brings the client back to the state of a new connection: out of pub/sub mode and transactions,
+// RESP2 on database 0 with the default user. The backend connections are left alone
+func (c *CommandSession) reset(out *bytes.Buffer) {
+
+	c.unsubscribeAll()
+	c.abortTransaction()
+
+	c.db = 0
+	c.protocol = 2
+	c.discov = c.manager.shards.Default()
+
+	if c.manager.users != nil {
+		c.user = c.manager.users.initial()
+	}
+
+	out.WriteString("+RESET\r\n")
+}
+
+// afterBatch follows the commands of a batch that changed the data behind our back, out holding their replies
+func (c *CommandSession) afterBatch(batch []*request, out *bytes.Buffer) {
+
+	for _, req := range batch {
+
+		switch req.name {
+		case "swapdb":
+			// the cached replies may now belong to the other database
+			c.manager.cache.Clear()
+
+		case "script":
+			// only scripts the master compiled are worth keeping (the reply is their SHA1)
+			loaded := req.replyEnd > req.replyStart && out.Bytes()[req.replyStart] == '$'
+
+			// the other instances (slaves and other shards) need the scripts the master has
+			for _, shard := range c.manager.shards.All() {
+				if len(req.args) == 3 && strings.ToLower(req.args[1]) == "load" && loaded {
+					shard.RegisterScript(req.args[2])
+				} else if len(req.args) >= 2 && strings.ToLower(req.args[1]) == "flush" {
+					shard.FlushScripts()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package session
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// replyError is sent back to the client as a RESP error reply. The code is the first word
+// of the reply (ERR, TRYAGAIN, READONLY...) that clients use to tell errors apart
+type replyError struct {
+	code string
+	msg  string
+}
+
+func (e *replyError) Error() string {
+	return e.code + " " + e.msg
+}
+
+func newReplyError(code, msg string) *replyError {
+	return &replyError{code: code, msg: msg}
+}
+
+// sendError is returned when a command could not be delivered to redis: it never ran so it can be retried
+func sendError(err error) *replyError {
+	return newReplyError("TRYAGAIN", "Unable to send the command to redis: "+err.Error())
+}
+
+// receiveError is returned when redis didn't answer: the command may or may not have run
+func receiveError(err error) *replyError {
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return newReplyError("ERR", "Timeout waiting for the reply from redis")
+	}
+
+	return newReplyError("ERR", "Unable to read the reply from redis: "+err.Error())
+}
+
+// writeError appends the RESP error reply for err to out
+func writeError(out *bytes.Buffer, err error) {
+
+	replyErr, ok := err.(*replyError)
+
+	if !ok {
+		replyErr = newReplyError("ERR", err.Error())
+	}
+
+	// error replies are single line
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(replyErr.Error())
+
+	out.WriteString("-")
+	out.WriteString(msg)
+	out.WriteString("\r\n")
+}
+
+// writeErrors answers every request in reqList with the same error
+func writeErrors(out *bytes.Buffer, reqList []*request, err error) {
+	for i := 0; i < len(reqList); i++ {
+		writeError(out, err)
+	}
+}
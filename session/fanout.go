@@ -0,0 +1,381 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"hargo/discovery"
+	"strconv"
+)
+
+// fanOutCommands are the multi-key commands split by shard when their keys are spread across shards:
+// the parts run in parallel and their replies are merged back into one
+var fanOutCommands = map[string]bool{
+	"mget":   true,
+	"mset":   true,
+	"del":    true,
+	"exists": true,
+	"unlink": true,
+	"touch":  true,
+}
+
+// broadcastCommands have no key but concern the data of every shard: with several shards they run on
+// all of them and their replies are merged
+var broadcastCommands = map[string]bool{
+	"flushall":  true,
+	"flushdb":   true,
+	"dbsize":    true,
+	"keys":      true,
+	"randomkey": true,
+}
+
+// unshardableCommands concern the data of every shard but their replies can't be merged
+var unshardableCommands = map[string]bool{
+	"scan": true,
+}
+
+// splittable returns true if the request is a well formed command of fanOutCommands
+// (malformed ones go to a single shard and get their error from redis)
+func splittable(req *request) bool {
+
+	if !fanOutCommands[req.name] {
+		return false
+	}
+
+	if req.name == "mset" {
+		return len(req.args) == 1+2*len(req.keys)
+	}
+
+	return len(req.args) == 1+len(req.keys)
+}
+
+// fanOutPart is the share of a split command going to one shard (one slot of it with redis cluster)
+type fanOutPart struct {
+	req *request
+	// index in the original request of each key of the part
+	positions []int
+
+	out *bytes.Buffer
+}
+
+// fanOutConn carries the parts going to one shard, pipelined on a single connection
+type fanOutConn struct {
+	shard    *discovery.Discovery
+	isHA     bool
+	partList []*fanOutPart
+
+	redis   *discovery.ConnWrapper
+	release func()
+	out     *bytes.Buffer
+	err     error
+}
+
+// fanOutTarget is where a part goes: a shard, and a slot of it with redis cluster (-1 otherwise)
+type fanOutTarget struct {
+	shard *discovery.Discovery
+	slot  int
+}
+
+// split groups the keys of the request by shard (by slot with redis cluster), each group keeping
+// the original order
+func (c *CommandSession) split(req *request) []*fanOutPart {
+
+	clustered := c.manager.shards.Clustered()
+
+	partMap := make(map[fanOutTarget]*fanOutPart)
+	partList := make([]*fanOutPart, 0, 2)
+
+	// a broadcast goes as it is to every shard
+	if broadcastCommands[req.name] {
+
+		for _, shard := range c.manager.shards.All() {
+			part := &fanOutPart{out: &bytes.Buffer{}}
+			part.req = &request{args: req.args, raw: req.raw, name: req.name, info: req.info, shard: shard}
+			partList = append(partList, part)
+		}
+
+		return partList
+	}
+
+	// MSET key value [key value ...], the others are COMMAND key [key ...]
+	step := 1
+	if req.name == "mset" {
+		step = 2
+	}
+
+	for index, key := range req.keys {
+
+		target := fanOutTarget{shard: c.manager.shards.ForKey(key), slot: -1}
+		if clustered {
+			target.slot = discovery.HashSlot(key)
+		}
+
+		part, ok := partMap[target]
+
+		if !ok {
+			part = &fanOutPart{out: &bytes.Buffer{}}
+			part.req = &request{args: []string{req.args[0]}, name: req.name, info: req.info, shard: target.shard}
+			partMap[target] = part
+			partList = append(partList, part)
+		}
+
+		first := 1 + index*step
+		part.req.args = append(part.req.args, req.args[first:first+step]...)
+		part.req.keys = append(part.req.keys, key)
+		part.positions = append(part.positions, index)
+	}
+
+	for _, part := range partList {
+		part.req.raw = formatCommand(part.req.args)
+	}
+
+	return partList
+}
+
+// fanOut sends every part of a split command to its shard before waiting for any reply, then merges
+// the replies in the order of the original keys
+func (c *CommandSession) fanOut(req *request, action Action, out *bytes.Buffer) {
+
+	partList := c.split(req)
+	connList := c.fanOutConns(partList, action)
+
+	// the connections are all checked out first, in the order of the shards: two sessions waiting
+	// for exhausted pools never hold what the other one waits for
+	for _, conn := range connList {
+		conn.redis, conn.release, _ = checkoutFrom(conn.shard, conn.isHA)
+		defer conn.release()
+	}
+
+	for _, conn := range connList {
+
+		conn.err = c.switchProtocol(conn.redis)
+
+		if conn.err == nil {
+			conn.err = c.switchDB(conn.redis)
+		}
+
+		if conn.err == nil {
+			conn.err = c.send(conn.redis, conn.batch(), conn.out)
+		}
+	}
+
+	for _, conn := range connList {
+
+		if conn.err == nil {
+			conn.err = c.receive(conn.redis, conn.batch(), conn.out, replyTimeout)
+		}
+
+		if conn.err == nil && c.manager.shards.Clustered() {
+			c.followRedirections(conn.batch(), conn.out)
+		}
+
+		// each part gets its own reply back
+		for _, part := range conn.partList {
+			if conn.err != nil {
+				writeError(part.out, conn.err)
+			} else {
+				part.out.Write(conn.out.Bytes()[part.req.replyStart:part.req.replyEnd])
+			}
+		}
+	}
+
+	if err := mergeReplies(req, partList, out); err != nil {
+		writeError(out, err)
+	}
+}
+
+// fanOutConns groups the parts by shard, in the order of the shards. A shard goes to its master if
+// any of its parts has to
+func (c *CommandSession) fanOutConns(partList []*fanOutPart, action Action) []*fanOutConn {
+
+	connMap := make(map[*discovery.Discovery]*fanOutConn)
+
+	for _, part := range partList {
+
+		conn, ok := connMap[part.req.shard]
+
+		if !ok {
+			conn = &fanOutConn{shard: part.req.shard, out: &bytes.Buffer{}}
+			connMap[part.req.shard] = conn
+		}
+
+		isHA := c.route(part.req, action)
+
+		if !isHA && action == ActionNone && c.consistency.mustReadMaster(part.req) {
+			isHA = true
+		}
+
+		conn.isHA = conn.isHA || isHA
+		conn.partList = append(conn.partList, part)
+	}
+
+	connList := make([]*fanOutConn, 0, len(connMap))
+
+	for _, shard := range c.manager.shards.All() {
+		if conn, ok := connMap[shard]; ok {
+			connList = append(connList, conn)
+			delete(connMap, shard)
+		}
+	}
+
+	// shards retired since the split come last
+	for _, conn := range connMap {
+		connList = append(connList, conn)
+	}
+
+	return connList
+}
+
+// batch returns the requests of the parts
+func (conn *fanOutConn) batch() []*request {
+
+	batch := make([]*request, 0, len(conn.partList))
+	for _, part := range conn.partList {
+		batch = append(batch, part.req)
+	}
+
+	return batch
+}
+
+// mergeReplies writes the reply of the original request from the replies of its parts.
+// The first error of a part is the reply (the other parts may have run)
+func mergeReplies(req *request, partList []*fanOutPart, out *bytes.Buffer) error {
+
+	for _, part := range partList {
+		if reply := part.out.Bytes(); len(reply) > 0 && (reply[0] == '-' || reply[0] == '!') {
+			out.Write(reply)
+			return nil
+		}
+	}
+
+	switch req.name {
+	case "mget":
+
+		elemList := make([][]byte, len(req.keys))
+
+		for _, part := range partList {
+
+			partElemList, err := splitArrayReply(part.out.Bytes())
+
+			if err != nil {
+				return err
+			}
+
+			if len(partElemList) != len(part.positions) {
+				return newReplyError("ERR", "Invalid reply from redis")
+			}
+
+			for index, position := range part.positions {
+				elemList[position] = partElemList[index]
+			}
+		}
+
+		out.WriteString("*" + strconv.Itoa(len(elemList)) + "\r\n")
+
+		for _, elem := range elemList {
+			out.Write(elem)
+		}
+
+	case "mset", "flushall", "flushdb":
+
+		out.WriteString("+OK\r\n")
+
+	case "keys":
+
+		elemList := make([][]byte, 0)
+
+		for _, part := range partList {
+
+			partElemList, err := splitArrayReply(part.out.Bytes())
+
+			if err != nil {
+				return err
+			}
+
+			elemList = append(elemList, partElemList...)
+		}
+
+		out.WriteString("*" + strconv.Itoa(len(elemList)) + "\r\n")
+
+		for _, elem := range elemList {
+			out.Write(elem)
+		}
+
+	case "randomkey":
+
+		// the first shard that isn't empty
+		for _, part := range partList {
+
+			reply := part.out.Bytes()
+
+			if !bytes.HasPrefix(reply, []byte("$-1")) && !bytes.HasPrefix(reply, []byte("_")) {
+				out.Write(reply)
+				return nil
+			}
+		}
+
+		out.Write(partList[0].out.Bytes())
+
+	default:
+
+		// DEL, EXISTS, UNLINK and TOUCH count the keys, DBSIZE counts them all
+		total := int64(0)
+
+		for _, part := range partList {
+
+			reply := part.out.Bytes()
+
+			if len(reply) < 3 || reply[0] != ':' {
+				return newReplyError("ERR", "Invalid reply from redis")
+			}
+
+			count, err := strconv.ParseInt(string(bytes.TrimSpace(reply[1:])), 10, 64)
+
+			if err != nil {
+				return newReplyError("ERR", "Invalid reply from redis")
+			}
+
+			total += count
+		}
+
+		out.WriteString(":" + strconv.FormatInt(total, 10) + "\r\n")
+	}
+
+	return nil
+}
+
+// splitArrayReply returns the raw elements of a complete array reply
+func splitArrayReply(reply []byte) ([][]byte, error) {
+
+	end := bytes.Index(reply, crlf)
+
+	if len(reply) == 0 || reply[0] != '*' || end == -1 {
+		return nil, fmt.Errorf("Protocol error: expected an array reply")
+	}
+
+	length, err := readReplyLength(reply[1:end])
+
+	if err != nil {
+		return nil, err
+	}
+
+	rest := reply[end+2:]
+	elemList := make([][]byte, 0, length)
+
+	for i := 0; i < length; i++ {
+
+		used, complete, err := newReplyParser().parse(rest)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !complete {
+			return nil, fmt.Errorf("Protocol error: truncated array reply")
+		}
+
+		elemList = append(elemList, rest[0:used])
+		rest = rest[used:]
+	}
+
+	return elemList, nil
+}
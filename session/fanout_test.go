@@ -0,0 +1,79 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newPart(reply string, positions ...int) *fanOutPart {
+	return &fanOutPart{out: bytes.NewBufferString(reply), positions: positions}
+}
+
+func TestMergeReplies(t *testing.T) {
+
+	tests := []struct {
+		req      *request
+		partList []*fanOutPart
+		want     string
+	}{
+		{
+			&request{name: "mget", keys: []string{"a", "b", "c"}},
+			[]*fanOutPart{newPart("*2\r\n$1\r\nA\r\n$-1\r\n", 0, 2), newPart("*1\r\n$2\r\nBB\r\n", 1)},
+			"*3\r\n$1\r\nA\r\n$2\r\nBB\r\n$-1\r\n",
+		},
+		{
+			&request{name: "mset", keys: []string{"a", "b"}},
+			[]*fanOutPart{newPart("+OK\r\n", 0), newPart("+OK\r\n", 1)},
+			"+OK\r\n",
+		},
+		{
+			&request{name: "del", keys: []string{"a", "b"}},
+			[]*fanOutPart{newPart(":1\r\n", 0), newPart(":1\r\n", 1)},
+			":2\r\n",
+		},
+		{
+			&request{name: "del", keys: []string{"a", "b"}},
+			[]*fanOutPart{newPart(":1\r\n", 0), newPart("-ERR x\r\n", 1)},
+			"-ERR x\r\n",
+		},
+		{
+			&request{name: "keys"},
+			[]*fanOutPart{newPart("*1\r\n$1\r\na\r\n"), newPart("*0\r\n"), newPart("*1\r\n$1\r\nb\r\n")},
+			"*2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		},
+		{
+			&request{name: "dbsize"},
+			[]*fanOutPart{newPart(":3\r\n"), newPart(":4\r\n")},
+			":7\r\n",
+		},
+		{
+			&request{name: "randomkey"},
+			[]*fanOutPart{newPart("$-1\r\n"), newPart("$1\r\nz\r\n")},
+			"$1\r\nz\r\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		out := &bytes.Buffer{}
+
+		if err := mergeReplies(test.req, test.partList, out); err != nil || out.String() != test.want {
+			t.Errorf("%s: got %q (%v), want %q", test.req.name, out.String(), err, test.want)
+		}
+	}
+}
+
+func TestSplitArrayReply(t *testing.T) {
+
+	elemList, err := splitArrayReply([]byte("*3\r\n$1\r\na\r\n*2\r\n:1\r\n:2\r\n$-1\r\n"))
+
+	if err != nil || len(elemList) != 3 || string(elemList[1]) != "*2\r\n:1\r\n:2\r\n" {
+		t.Fatalf("%q %v", elemList, err)
+	}
+
+	for _, reply := range []string{":1\r\n", "*2\r\n$1\r\na\r\n", "*1"} {
+		if _, err := splitArrayReply([]byte(reply)); err == nil {
+			t.Errorf("%q: expected an error", reply)
+		}
+	}
+}
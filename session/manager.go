@@ -1,34 +1,73 @@
 package session
 
 import (
+	"fmt"
+	"hargo/config"
 	"hargo/discovery"
 	"net"
+	"strings"
+	"time"
 )
 
-var slaveSafeCommandMap map[string]bool
+type Manager struct {
+	shards *discovery.Shards
+	cache  *Cache
+	rules  *Rules
+	// nil when the clients don't authenticate
+	users *Users
 
-func init() {
+	consistencyMode   consistencyMode
+	consistencyWindow time.Duration
 
-	slaveSafeCommandMap = map[string]bool{
-		"get":      true,
-		"lrange":   true,
-		"smembers": true,
-		"hgetall":  true,
-	}
+	// one slot per blocked client (nil means no limit)
+	blockers chan struct{}
 }
 
-type Manager struct {
-	discov *discovery.Discovery
-	cache  *Cache
-}
+func NewManager(shards *discovery.Shards, cache *Cache, cfg *config.Config) (*Manager, error) {
+
+	var err error
 
-func NewManager(discov *discovery.Discovery, cache *Cache) *Manager {
 	manager := &Manager{}
-	manager.discov = discov
+	manager.shards = shards
 	manager.cache = cache
-	return manager
+
+	manager.rules, err = NewRules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.users, err = NewUsers(cfg.Users)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, ok := consistencyModeNames[strings.ToLower(cfg.Consistency.Mode)]
+	if !ok {
+		return nil, fmt.Errorf("Manager: unknown consistency mode '%s'", cfg.Consistency.Mode)
+	}
+
+	manager.consistencyMode = mode
+	manager.consistencyWindow = time.Duration(cfg.Consistency.WindowMs) * time.Millisecond
+
+	if cfg.Blocking.MaxClients > 0 {
+		manager.blockers = make(chan struct{}, cfg.Blocking.MaxClients)
+	}
+
+	return manager, nil
 }
 
 func (m *Manager) NewCommandSession(client net.Conn) *CommandSession {
-	return &CommandSession{manager: m, client: client, isHA: true, readBuf: make([]byte, 4096)}
+	session := &CommandSession{manager: m, client: client, isHA: true, readBuf: make([]byte, 4096), parser: newRequestParser(), protocol: 2}
+	session.consistency = newReadYourWrites(m.consistencyMode, m.consistencyWindow)
+	session.discov = m.shards.Default()
+
+	if m.users != nil {
+		session.user = m.users.initial()
+	}
+
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		session.clientIP = addr.IP
+	}
+
+	return session
 }
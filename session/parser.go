@@ -1,91 +1,426 @@
 package session
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hargo/command"
+	"hargo/discovery"
 	"strconv"
 )
 
-func lowReadString(src []byte) ([]byte, string, error) {
+const (
+	// hard limit on a single buffered request (same as redis' default proto-max-bulk-len)
+	maxRequestSize = 512 * 1024 * 1024
+	// redis refuses multibulk requests with more arguments than this
+	maxArgCount = 1024 * 1024
+	// arguments allocated up front, the declared count comes from the client
+	argPrealloc = 1024
+	// and inline commands longer than this
+	maxInlineSize = 64 * 1024
+)
 
-	ret := ""
-	i := 0
-	for {
-		if src[i] == 13 && src[i+1] == 10 {
-			break
+var crlf = []byte{'\r', '\n'}
+
+// errIncomplete is returned when the buffer ends before a full request has been read
+var errIncomplete = errors.New("incomplete request")
+
+// request is a single client command: the parsed arguments and the raw bytes
+// as they came off the wire (forwarded unchanged to redis)
+type request struct {
+	args []string
+	raw  []byte
+
+	// filled by the session before routing
+	name      string
+	info      *command.Info
+	keys      []string
+	cacheable bool
+	shard     *discovery.Discovery
+	// keys spread across shards, the command is split
+	fanOut bool
+
+	// where the reply of the request sits in the client output, once received
+	replyStart int
+	replyEnd   int
+}
+
+// requestParser keeps the bytes read from a client across reads and hands out
+// complete commands only. The request being decoded keeps its state between reads:
+// the arguments already decoded are not read again
+type requestParser struct {
+	buf []byte
+
+	// bytes of buf already decoded (or scanned for inline commands)
+	pos int
+	// declared argument count of the multibulk request being decoded, -1 before its header
+	argCount int
+	args     []string
+}
+
+func newRequestParser() *requestParser {
+	return &requestParser{argCount: -1}
+}
+
+// feed appends freshly read client data to the parser buffer
+func (p *requestParser) feed(data []byte) error {
+
+	if len(p.buf)+len(data) > maxRequestSize {
+		return fmt.Errorf("Protocol error: request exceeds the maximum size of %d bytes", maxRequestSize)
+	}
+
+	p.buf = append(p.buf, data...)
+	return nil
+}
+
+// next returns the next complete request in the buffer or nil if more data is needed
+func (p *requestParser) next() (*request, error) {
+
+	for len(p.buf) > 0 {
+
+		var args []string
+		var err error
+
+		if p.buf[0] == '*' {
+			args, err = p.readMultiBulk()
+		} else {
+			args, err = p.readInline()
+		}
+
+		if err == errIncomplete {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the raw command is capped so that later appends never overwrite it
+		raw := p.buf[0:p.pos:p.pos]
+
+		p.buf = p.buf[p.pos:]
+		p.pos = 0
+		p.argCount = -1
+		p.args = nil
+
+		// empty requests are skipped (as redis does)
+		if len(args) == 0 {
+			continue
+		}
+
+		// inline commands are sent to redis as multibulk requests
+		if raw[0] != '*' {
+			raw = formatCommand(args)
+		}
+
+		return &request{args: args, raw: raw}, nil
+	}
+
+	// nothing left, we release the underlying array
+	p.buf = nil
+
+	return nil, nil
+}
+
+// readMultiBulk goes on decoding the multibulk request at the start of the buffer from where
+// the previous read stopped
+func (p *requestParser) readMultiBulk() ([]string, error) {
+
+	if p.argCount < 0 {
+
+		rest, argCount, err := lowReadInteger(p.buf[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if argCount > maxArgCount {
+			return nil, fmt.Errorf("Protocol error: invalid multibulk length")
+		}
+
+		p.pos = len(p.buf) - len(rest)
+		p.argCount = argCount
+
+		if argCount <= 0 {
+			return nil, nil
+		}
+
+		// the arguments are appended as they arrive
+		prealloc := argCount
+		if prealloc > argPrealloc {
+			prealloc = argPrealloc
+		}
+
+		p.args = make([]string, 0, prealloc)
+	}
+
+	for len(p.args) < p.argCount {
+
+		rest, arg, err := readBulkString(p.buf[p.pos:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.args = append(p.args, arg)
+		p.pos = len(p.buf) - len(rest)
+	}
+
+	return p.args, nil
+}
+
+// readInline reads the inline command at the start of the buffer, the bytes already scanned
+// for its end of line are not scanned again
+func (p *requestParser) readInline() ([]string, error) {
+
+	end := bytes.IndexByte(p.buf[p.pos:], '\n')
+
+	if end == -1 {
+
+		p.pos = len(p.buf)
+
+		if p.pos > maxInlineSize {
+			return nil, fmt.Errorf("Protocol error: too big inline request")
 		}
-		ret += string(src[i])
-		i++
+
+		return nil, errIncomplete
 	}
 
-	return src[i+2:], ret, nil
+	end += p.pos
+	p.pos = end + 1
+
+	line := p.buf[0:end]
+
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[0 : len(line)-1]
+	}
+
+	return splitInlineArgs(line)
 }
 
+// lowReadInteger reads a CRLF terminated decimal number without allocating
 func lowReadInteger(src []byte) ([]byte, int, error) {
-	src, str, err := lowReadString(src)
 
-	if err != nil {
-		return src, -1, err
+	end := bytes.Index(src, crlf)
+
+	if end == -1 {
+		return src, -1, errIncomplete
 	}
 
-	number, err := strconv.Atoi(str)
-	return src, number, err
+	if end == 0 {
+		return src, -1, fmt.Errorf("Protocol error: empty length")
+	}
+
+	number := 0
+	negative := src[0] == '-'
+
+	start := 0
+	if negative {
+		start = 1
+	}
+
+	for i := start; i < end; i++ {
+
+		if src[i] < '0' || src[i] > '9' {
+			return src, -1, fmt.Errorf("Protocol error: invalid length '%s'", string(src[0:end]))
+		}
+
+		number = number*10 + int(src[i]-'0')
+
+		if number > maxRequestSize {
+			return src, -1, fmt.Errorf("Protocol error: length %s out of range", string(src[0:end]))
+		}
+	}
+
+	if negative {
+		number = -number
+	}
+
+	return src[end+2:], number, nil
 }
 
+// readBulkString reads a $<len> prefixed string. The declared length is trusted so the
+// payload may contain any byte, CRLF included
 func readBulkString(src []byte) ([]byte, string, error) {
 
+	if len(src) == 0 {
+		return src, "", errIncomplete
+	}
+
 	// $
 	if src[0] != '$' {
-		return src, "", fmt.Errorf("Bulk string doesn't start with $ but with '%c' / %d", src[0], src[0])
+		return src, "", fmt.Errorf("Protocol error: expected '$', got '%c'", src[0])
 	}
 
-	src, _, err := lowReadInteger(src[1:])
+	rest, length, err := lowReadInteger(src[1:])
 
 	if err != nil {
 		return src, "", err
 	}
 
-	src, str, err := lowReadString(src)
+	if length < 0 {
+		return src, "", fmt.Errorf("Protocol error: invalid bulk length %d", length)
+	}
 
-	if err != nil {
-		return src, "", err
+	// payload + CRLF
+	if len(rest) < length+2 {
+		return src, "", errIncomplete
 	}
 
-	return src, str, nil
+	if rest[length] != '\r' || rest[length+1] != '\n' {
+		return src, "", fmt.Errorf("Protocol error: bulk string of %d bytes not terminated by CRLF", length)
+	}
+
+	return rest[length+2:], string(rest[0:length]), nil
 }
 
-func readRequest(src []byte) ([]string, error) {
+// splitInlineArgs splits an inline command line honoring double quoted strings (with C like escapes)
+// and single quoted strings, the same way redis does
+func splitInlineArgs(line []byte) ([]string, error) {
 
-	if len(src) == 4 && string(src) == "PING" {
-		return []string{"PING"}, nil
-	}
+	argList := make([]string, 0, 4)
+	i := 0
 
-	return readBulkStringArray(src)
-}
+	for {
 
-func readBulkStringArray(src []byte) ([]string, error) {
+		// we skip the blanks
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
 
-	if src[0] != '*' {
-		return nil, fmt.Errorf("Array doesn't start with * but with %c", src[0])
-	}
+		if i == len(line) {
+			return argList, nil
+		}
 
-	// we read the number of items
-	src, arraySize, err := lowReadInteger(src[1:])
+		arg := make([]byte, 0, 16)
+		inDoubleQuotes := false
+		inSingleQuotes := false
+		done := false
 
-	if err != nil {
-		return nil, err
-	}
+		for !done {
 
-	retList := make([]string, arraySize)
+			switch {
+			case inDoubleQuotes:
 
-	for i := 0; i < arraySize; i++ {
+				if i == len(line) {
+					return nil, fmt.Errorf("Protocol error: unbalanced quotes in request")
+				}
 
-		src, retList[i], err = readBulkString(src)
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexDigitValue(line[i+2])*16+hexDigitValue(line[i+3]))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("Protocol error: unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
 
-		if err != nil {
-			return nil, err
+			case inSingleQuotes:
+
+				if i == len(line) {
+					return nil, fmt.Errorf("Protocol error: unbalanced quotes in request")
+				}
+
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if line[i] == '\'' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("Protocol error: unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, line[i])
+				}
+
+			default:
+
+				if i == len(line) {
+					done = true
+					continue
+				}
+
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
 		}
+
+		argList = append(argList, string(arg))
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == 0
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// formatCommand encodes a command as a multibulk request
+func formatCommand(argList []string) []byte {
+
+	size := 16
+	for _, arg := range argList {
+		size += len(arg) + 16
 	}
 
-	return retList, nil
+	ret := make([]byte, 0, size)
+	ret = append(ret, '*')
+	ret = strconv.AppendInt(ret, int64(len(argList)), 10)
+	ret = append(ret, '\r', '\n')
+
+	for _, arg := range argList {
+		ret = append(ret, '$')
+		ret = strconv.AppendInt(ret, int64(len(arg)), 10)
+		ret = append(ret, '\r', '\n')
+		ret = append(ret, arg...)
+		ret = append(ret, '\r', '\n')
+	}
 
+	return ret
 }
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"hargo/command"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestRequest builds a request described by the default command table
+func newTestRequest(args ...string) *request {
+
+	req := &request{args: args, name: strings.ToLower(args[0])}
+	req.info = command.Default().Lookup(req.name)
+
+	if req.info != nil {
+		req.keys = req.info.Keys(args)
+	}
+
+	return req
+}
+
+// parseAll feeds the input step bytes at a time and returns the arguments of every request
+func parseAll(t *testing.T, input string, step int) [][]string {
+
+	p := newRequestParser()
+	argsList := make([][]string, 0)
+
+	for start := 0; start < len(input); start += step {
+
+		end := start + step
+		if end > len(input) {
+			end = len(input)
+		}
+
+		if err := p.feed([]byte(input[start:end])); err != nil {
+			t.Fatalf("feed: %v", err)
+		}
+
+		for {
+			req, err := p.next()
+
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+
+			if req == nil {
+				break
+			}
+
+			argsList = append(argsList, req.args)
+		}
+	}
+
+	return argsList
+}
+
+func TestRequestParserSplitReads(t *testing.T) {
+
+	tests := []struct {
+		input string
+		want  [][]string
+	}{
+		{"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", [][]string{{"GET", "foo"}}},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$6\r\na\r\nb\r\n\r\n", [][]string{{"SET", "k", "a\r\nb\r\n"}}},
+		{"*1\r\n$4\r\nPING\r\n*0\r\n*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", [][]string{{"PING"}, {"ECHO", ""}}},
+		{"PING\r\nget k\n\r\n", [][]string{{"PING"}, {"get", "k"}}},
+		{"set k \"a b\\x41\\n\" 'it\\'s'\r\n", [][]string{{"set", "k", "a bA\n", "it's"}}},
+	}
+
+	for _, test := range tests {
+		for step := 1; step <= len(test.input); step++ {
+			if got := parseAll(t, test.input, step); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("%q in reads of %d bytes: got %q, want %q", test.input, step, got, test.want)
+			}
+		}
+	}
+}
+
+func TestRequestParserRaw(t *testing.T) {
+
+	p := newRequestParser()
+	p.feed([]byte("PING\r\n*1\r\n$4\r\nPING\r\n"))
+
+	for i := 0; i < 2; i++ {
+		req, err := p.next()
+
+		if err != nil || req == nil || string(req.raw) != "*1\r\n$4\r\nPING\r\n" {
+			t.Fatalf("request %d: %v %v", i, req, err)
+		}
+	}
+}
+
+func TestRequestParserErrors(t *testing.T) {
+
+	tests := []string{
+		"*536870911\r\n",
+		"*2\r\n+GET\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*x\r\n",
+		"get \"foo\"bar\n",
+		"get 'foo\n",
+	}
+
+	for _, input := range tests {
+
+		p := newRequestParser()
+		p.feed([]byte(input))
+
+		if _, err := p.next(); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestRequestParserPreallocation(t *testing.T) {
+
+	p := newRequestParser()
+	p.feed([]byte("*1048576\r\n$3\r\nfoo\r\n"))
+
+	req, err := p.next()
+
+	if err != nil || req != nil {
+		t.Fatalf("expected an incomplete request, got %v %v", req, err)
+	}
+
+	if len(p.args) != 1 || cap(p.args) > argPrealloc {
+		t.Fatalf("%d arguments decoded, %d allocated", len(p.args), cap(p.args))
+	}
+}
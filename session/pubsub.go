@@ -0,0 +1,552 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"hargo/discovery"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var subscribeCommandMap = map[string]bool{
+	"subscribe":  true,
+	"psubscribe": true,
+	"ssubscribe": true,
+}
+
+var pubsubCommandMap = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"ssubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"sunsubscribe": true,
+}
+
+// subscriber owns a dedicated master connection of a client in pub/sub mode. The session writes
+// the client commands to it while a goroutine streams everything redis sends back to the client.
+// When the master changes the subscriptions are replayed on the new one
+type subscriber struct {
+	session *CommandSession
+	shard   *discovery.Discovery
+	readBuf []byte
+
+	mutex     sync.Mutex
+	conn      *discovery.ConnWrapper
+	signature string
+	closed    bool
+
+	// protocol of the client, the session keeps it up to date on HELLO
+	protocol int
+
+	// subscriptions to replay after a failover
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+
+	// replies of a replay, not forwarded to the client
+	dropHello   bool
+	dropConfirm int
+
+	// confirmations the client is still waiting for, settled is closed once they are all there
+	pending int
+	settled chan struct{}
+}
+
+func newSubscriber(c *CommandSession, shard *discovery.Discovery) (*subscriber, error) {
+
+	s := &subscriber{session: c, shard: shard, readBuf: make([]byte, 4096), protocol: c.protocol}
+	s.channels = make(map[string]bool)
+	s.patterns = make(map[string]bool)
+	s.shardChannels = make(map[string]bool)
+
+	if err := s.connect(); err != nil {
+		// nobody else would close the dedicated connection
+		s.conn.Destroy()
+		return nil, err
+	}
+
+	go s.stream()
+
+	return s, nil
+}
+
+// connect opens a dedicated connection to the current master and replays the subscriptions
+func (s *subscriber) connect() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn != nil {
+		s.conn.Destroy()
+	}
+
+	s.conn = s.shard.NewMasterConn()
+	s.signature = s.conn.Signature()
+
+	// the confirmations of the lost connection won't come
+	s.pending = 0
+	if s.settled != nil {
+		close(s.settled)
+		s.settled = nil
+	}
+
+	if !s.conn.IsConnected() {
+		return sendError(fmt.Errorf("no connection to the master %s", s.conn.HostPort()))
+	}
+
+	replay := make([]byte, 0, 256)
+
+	// the connection must speak the same protocol as the client
+	if s.protocol != 2 {
+		replay = append(replay, formatCommand([]string{"HELLO", strconv.Itoa(s.protocol)})...)
+		s.dropHello = true
+	}
+
+	s.dropConfirm = 0
+
+	for _, subscriptions := range []struct {
+		command string
+		names   map[string]bool
+	}{{"SUBSCRIBE", s.channels}, {"PSUBSCRIBE", s.patterns}, {"SSUBSCRIBE", s.shardChannels}} {
+
+		if len(subscriptions.names) == 0 {
+			continue
+		}
+
+		args := []string{subscriptions.command}
+		for name := range subscriptions.names {
+			args = append(args, name)
+		}
+
+		replay = append(replay, formatCommand(args)...)
+		s.dropConfirm += len(subscriptions.names)
+	}
+
+	if len(replay) == 0 {
+		return nil
+	}
+
+	return s.write(replay)
+}
+
+// setProtocol follows a HELLO of the client, the next connection to the master speaks the new protocol
+func (s *subscriber) setProtocol(protocol int) {
+
+	s.mutex.Lock()
+	s.protocol = protocol
+	s.mutex.Unlock()
+}
+
+// send writes a client command to the subscriber connection, the reply is streamed back by the goroutine
+func (s *subscriber) send(req *request) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.track(req)
+
+	return s.write(req.raw)
+}
+
+// write sends src to redis (the mutex must be held)
+func (s *subscriber) write(src []byte) error {
+
+	writtenSoFar := 0
+
+	for writtenSoFar < len(src) {
+
+		// we time out after 10 seconds
+		s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+		written, err := s.conn.Write(src[writtenSoFar:])
+
+		if err != nil {
+			return sendError(err)
+		}
+
+		writtenSoFar += written
+	}
+
+	return nil
+}
+
+// track keeps the list of subscriptions up to date (the mutex must be held)
+func (s *subscriber) track(req *request) {
+
+	var names map[string]bool
+
+	switch req.name {
+	case "subscribe", "unsubscribe":
+		names = s.channels
+	case "psubscribe", "punsubscribe":
+		names = s.patterns
+	case "ssubscribe", "sunsubscribe":
+		names = s.shardChannels
+	default:
+		return
+	}
+
+	// redis confirms each name, or once when unsubscribing from nothing
+	confirmations := len(req.args) - 1
+	if confirmations == 0 && !subscribeCommandMap[req.name] {
+		confirmations = len(names)
+		if confirmations == 0 {
+			confirmations = 1
+		}
+	}
+
+	if s.pending == 0 && confirmations > 0 {
+		s.settled = make(chan struct{})
+	}
+	s.pending += confirmations
+
+	if subscribeCommandMap[req.name] {
+		for _, name := range req.args[1:] {
+			names[name] = true
+		}
+		return
+	}
+
+	// no argument unsubscribes from everything
+	if len(req.args) == 1 {
+		for name := range names {
+			delete(names, name)
+		}
+		return
+	}
+
+	for _, name := range req.args[1:] {
+		delete(names, name)
+	}
+}
+
+// stream forwards replies and messages to the client until the subscriber is closed
+func (s *subscriber) stream() {
+
+	parser := newReplyParser()
+	respBuffer := &bytes.Buffer{}
+
+	for {
+
+		s.mutex.Lock()
+		conn, signature, closed := s.conn, s.signature, s.closed
+		s.mutex.Unlock()
+
+		if closed {
+			return
+		}
+
+		var err error
+		read := 0
+
+		// a connection re-established behind our back would have lost the subscriptions
+		if conn.IsConnected() {
+
+			// we wake up every second to check for a failover
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			read, err = conn.Read(s.readBuf)
+		} else {
+			err = fmt.Errorf("not connected to %s", conn.HostPort())
+		}
+
+		if err != nil {
+
+			netErr, ok := err.(net.Error)
+			timeout := ok && netErr.Timeout()
+
+			if timeout && s.shard.MasterSignature() == signature {
+				continue
+			}
+
+			if s.isClosed() {
+				return
+			}
+
+			if !timeout {
+				log.Printf("Subscriber connection lost because: %v", err)
+				time.Sleep(time.Second)
+			} else {
+				log.Printf("Subscriber moving to the new master")
+			}
+
+			// half read replies are lost with the connection
+			parser = newReplyParser()
+			respBuffer.Reset()
+
+			if err := s.connect(); err != nil {
+				log.Printf("Unable to restore the subscriptions because: %v", err)
+			}
+
+			continue
+		}
+
+		chunk := s.readBuf[0:read]
+
+		for len(chunk) > 0 {
+
+			used, complete, err := parser.parse(chunk)
+
+			if err != nil {
+				log.Printf("Unable to parse pub/sub message from redis because: %v", err)
+				conn.Disconnect()
+				break
+			}
+
+			respBuffer.Write(chunk[0:used])
+			chunk = chunk[used:]
+
+			if !complete {
+				continue
+			}
+
+			if !s.drop(respBuffer.Bytes()) {
+
+				if err := s.session.writeClient(respBuffer.Bytes()); err != nil {
+					s.close()
+					s.session.client.Close()
+					return
+				}
+
+				if pubsubCommandMap[pubsubKind(respBuffer.Bytes())] {
+					s.confirmed()
+				}
+			}
+
+			respBuffer.Reset()
+		}
+	}
+}
+
+// drop returns true for the replies of a replay (the client already got them once)
+func (s *subscriber) drop(reply []byte) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.dropHello {
+		s.dropHello = false
+		return true
+	}
+
+	if s.dropConfirm > 0 && subscribeCommandMap[pubsubKind(reply)] {
+		s.dropConfirm--
+		return true
+	}
+
+	return false
+}
+
+// confirmed counts a confirmation forwarded to the client
+func (s *subscriber) confirmed() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending == 0 {
+		return
+	}
+
+	s.pending--
+
+	if s.pending == 0 {
+		close(s.settled)
+		s.settled = nil
+	}
+}
+
+// settle waits until the client got every confirmation, at most timeout
+func (s *subscriber) settle(timeout time.Duration) {
+
+	s.mutex.Lock()
+	settled := s.settled
+	s.mutex.Unlock()
+
+	if settled == nil {
+		return
+	}
+
+	select {
+	case <-settled:
+	case <-time.After(timeout):
+		log.Printf("Subscriber confirmations still missing after %v", timeout)
+	}
+}
+
+// count returns the number of subscriptions (the one redis reports in its confirmations)
+func (s *subscriber) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.channels) + len(s.patterns) + len(s.shardChannels)
+}
+
+// hasShardChannels returns true if the subscriber holds shard channel subscriptions
+func (s *subscriber) hasShardChannels() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.shardChannels) > 0
+}
+
+func (s *subscriber) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// close drops the dedicated connection, the goroutine stops on its own
+func (s *subscriber) close() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.conn.Destroy()
+}
+
+// pubsubKind returns the first element of an array or push reply ("message", "subscribe"...), "" otherwise
+func pubsubKind(reply []byte) string {
+
+	if len(reply) == 0 || (reply[0] != '*' && reply[0] != '>') {
+		return ""
+	}
+
+	end := bytes.Index(reply, crlf)
+
+	if end == -1 || end+2 >= len(reply) || reply[end+2] != '$' {
+		return ""
+	}
+
+	_, kind, err := readBulkString(reply[end+2:])
+
+	if err != nil {
+		return ""
+	}
+
+	return kind
+}
+
+// subscribing returns true if the request has to go through a subscriber connection
+func (c *CommandSession) subscribing(req *request) bool {
+
+	// transactions queue the command as any other
+	if c.tx.active() {
+		return false
+	}
+
+	if subscribeCommandMap[req.name] || (pubsubCommandMap[req.name] && len(c.subs) > 0) {
+		return true
+	}
+
+	// with RESP2 redis only accepts pub/sub commands (and PING) from a subscribed client, RESP3 allows everything
+	return c.protocol == 2 && c.subscriptionCount() > 0
+}
+
+// subscriptionCount returns the number of subscriptions of the client, on every shard
+func (c *CommandSession) subscriptionCount() int {
+
+	count := 0
+	for _, sub := range c.subs {
+		count += sub.count()
+	}
+
+	return count
+}
+
+// subscribe sends a pub/sub command to the subscriber connections it concerns, starting them if needed
+func (c *CommandSession) subscribe(req *request) error {
+
+	subList, err := c.subscribersOf(req)
+
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subList {
+		if err := sub.send(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// subscribersOf returns the subscribers of a request. Channels and patterns live on the default shard,
+// shard channels on the shard of their slot with redis cluster
+func (c *CommandSession) subscribersOf(req *request) ([]*subscriber, error) {
+
+	defaultShard := c.manager.shards.Default()
+
+	// SUNSUBSCRIBE without channel leaves the shard channels of every shard
+	if req.name == "sunsubscribe" && len(req.args) == 1 {
+
+		subList := make([]*subscriber, 0, len(c.subs))
+		for _, sub := range c.subs {
+			if sub.hasShardChannels() {
+				subList = append(subList, sub)
+			}
+		}
+
+		if len(subList) > 0 {
+			return subList, nil
+		}
+	}
+
+	shard := defaultShard
+	if pubsubCommandMap[req.name] && req.shard != nil {
+		shard = req.shard
+	}
+
+	if sub, ok := c.subs[shard]; ok {
+		return []*subscriber{sub}, nil
+	}
+
+	// the other commands of a subscribed RESP2 client (PING) go to any of its subscribers
+	if !pubsubCommandMap[req.name] {
+		for _, sub := range c.subs {
+			return []*subscriber{sub}, nil
+		}
+	}
+
+	sub, err := newSubscriber(c, shard)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.subs == nil {
+		c.subs = make(map[*discovery.Discovery]*subscriber)
+	}
+
+	c.subs[shard] = sub
+
+	return []*subscriber{sub}, nil
+}
+
+// leavePubSub closes the subscriber connections of a client that has no subscription left, once
+// the client got the last confirmations
+func (c *CommandSession) leavePubSub() {
+
+	for _, sub := range c.subs {
+		sub.settle(replyTimeout)
+	}
+
+	c.unsubscribeAll()
+}
+
+// unsubscribeAll closes the subscriber connections
+func (c *CommandSession) unsubscribeAll() {
+
+	for _, sub := range c.subs {
+		sub.close()
+	}
+
+	c.subs = nil
+}
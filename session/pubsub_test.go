@@ -0,0 +1,50 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubsubKind(t *testing.T) {
+
+	tests := map[string]string{
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n":    "subscribe",
+		">3\r\n$7\r\nmessage\r\n$1\r\na\r\n$1\r\nx\r\n": "message",
+		"+OK\r\n": "",
+		"*":       "",
+	}
+
+	for reply, want := range tests {
+		if got := pubsubKind([]byte(reply)); got != want {
+			t.Errorf("%q: got %q, want %q", reply, got, want)
+		}
+	}
+}
+
+func TestSubscriberConfirmations(t *testing.T) {
+
+	s := &subscriber{channels: map[string]bool{}, patterns: map[string]bool{}, shardChannels: map[string]bool{}}
+
+	s.track(&request{name: "subscribe", args: []string{"SUBSCRIBE", "a", "b"}})
+	s.track(&request{name: "unsubscribe", args: []string{"UNSUBSCRIBE"}})
+	s.track(&request{name: "punsubscribe", args: []string{"PUNSUBSCRIBE"}})
+
+	// two subscriptions, one unsubscription each, one for the empty PUNSUBSCRIBE
+	if s.pending != 5 || s.count() != 0 {
+		t.Fatalf("%d pending, %d subscriptions", s.pending, s.count())
+	}
+
+	settled := s.settled
+
+	for i := 0; i < 5; i++ {
+		s.confirmed()
+	}
+
+	select {
+	case <-settled:
+	default:
+		t.Fatal("not settled")
+	}
+
+	s.settle(time.Second)
+}
@@ -0,0 +1,263 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+const (
+	// longest reply header line we are willing to buffer (type byte + length + CRLF)
+	maxReplyHeaderSize = 64 * 1024
+)
+
+// replyAggregate is an array, map, set, push or attribute still being read
+type replyAggregate struct {
+	left      int
+	attribute bool
+}
+
+// replyParser follows redis replies (RESP2 and RESP3) as they come in, one read at a time.
+// It keeps the number of items still expected by every open aggregate (aggregates can be nested)
+// and the bytes still missing from the current bulk string, so it knows exactly where a reply ends
+type replyParser struct {
+	// open aggregates, innermost last
+	pending []replyAggregate
+	// bytes left in the current bulk string (payload + CRLF)
+	bulkLeft int
+	// header line split across reads
+	line []byte
+	// the current reply is an out of band push message
+	push bool
+	// the last complete reply was a push message
+	lastPush bool
+}
+
+func newReplyParser() *replyParser {
+	return &replyParser{}
+}
+
+// parse consumes src until the end of the current reply. It returns the number of bytes used
+// and whether the reply is complete: in that case the parser is ready for the next reply
+// and the remaining bytes belong to it
+func (p *replyParser) parse(src []byte) (int, bool, error) {
+
+	i := 0
+
+	for i < len(src) {
+
+		// we skip through the bulk string payload
+		if p.bulkLeft > 0 {
+
+			n := len(src) - i
+			if n > p.bulkLeft {
+				n = p.bulkLeft
+			}
+
+			i += n
+			p.bulkLeft -= n
+
+			if p.bulkLeft > 0 {
+				return i, false, nil
+			}
+
+			if p.itemDone() {
+				return i, p.complete(), nil
+			}
+
+			continue
+		}
+
+		// we read the header line
+		end := bytes.IndexByte(src[i:], '\n')
+
+		if end == -1 {
+
+			if len(p.line)+len(src)-i > maxReplyHeaderSize {
+				return i, false, fmt.Errorf("Protocol error: reply header too long")
+			}
+
+			p.line = append(p.line, src[i:]...)
+			return len(src), false, nil
+		}
+
+		line := src[i : i+end+1]
+		i += end + 1
+
+		if len(p.line) > 0 {
+			p.line = append(p.line, line...)
+			line = p.line
+		}
+
+		complete, err := p.header(line)
+		p.line = p.line[0:0]
+
+		if err != nil {
+			return i, false, err
+		}
+
+		if complete {
+			return i, p.complete(), nil
+		}
+	}
+
+	return i, false, nil
+}
+
+// complete resets the per reply state once a whole reply has been read
+func (p *replyParser) complete() bool {
+	p.lastPush = p.push
+	p.push = false
+	return true
+}
+
+// wasPush returns true if the last complete reply was a RESP3 push message (not an answer to a command)
+func (p *replyParser) wasPush() bool {
+	return p.lastPush
+}
+
+// header handles a full header line (CRLF included) and returns true if the reply is complete
+func (p *replyParser) header(line []byte) (bool, error) {
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return false, fmt.Errorf("Protocol error: malformed reply line '%s'", string(line))
+	}
+
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+', '-', ':': // string, error or number
+
+		return p.itemDone(), nil
+
+	case '_', ',', '#', '(': // RESP3 null, double, boolean and big number
+
+		return p.itemDone(), nil
+
+	case '$', '!', '=': // bulk string, RESP3 bulk error and verbatim string
+
+		length, err := readReplyLength(body)
+
+		if err != nil {
+			return false, err
+		}
+
+		// nil bulk string
+		if length < 0 {
+			return p.itemDone(), nil
+		}
+
+		p.bulkLeft = length + 2
+		return false, nil
+
+	case '*', '~', '>': // array, RESP3 set and push
+
+		length, err := readReplyLength(body)
+
+		if err != nil {
+			return false, err
+		}
+
+		if line[0] == '>' && len(p.pending) == 0 {
+			p.push = true
+		}
+
+		return p.aggregate(length, false), nil
+
+	case '%', '|': // RESP3 map and attribute (key value pairs)
+
+		length, err := readReplyLength(body)
+
+		if err != nil {
+			return false, err
+		}
+
+		if length > math.MaxInt32/2 {
+			return false, fmt.Errorf("Protocol error: map length %d out of range", length)
+		}
+
+		return p.aggregate(length*2, line[0] == '|'), nil
+
+	default:
+		return false, fmt.Errorf("Protocol error: unexpected reply type '%c'", line[0])
+	}
+}
+
+// aggregate opens an aggregate of the given number of items and returns true if the reply is complete
+func (p *replyParser) aggregate(length int, attribute bool) bool {
+
+	// nil or empty aggregate
+	if length <= 0 {
+
+		// an empty attribute is just skipped
+		if attribute {
+			return false
+		}
+
+		return p.itemDone()
+	}
+
+	p.pending = append(p.pending, replyAggregate{left: length, attribute: attribute})
+	return false
+}
+
+// itemDone accounts for a complete item and returns true if it completed the whole reply
+func (p *replyParser) itemDone() bool {
+
+	for len(p.pending) > 0 {
+
+		top := len(p.pending) - 1
+		p.pending[top].left--
+
+		if p.pending[top].left > 0 {
+			return false
+		}
+
+		attribute := p.pending[top].attribute
+
+		// the aggregate is complete and counts as an item of its parent
+		p.pending = p.pending[0:top]
+
+		// attributes decorate the item that follows them, they don't count themselves
+		if attribute {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readReplyLength reads the length of a bulk string or aggregate (-1 is nil)
+func readReplyLength(src []byte) (int, error) {
+
+	if len(src) == 0 {
+		return 0, fmt.Errorf("Protocol error: empty reply length")
+	}
+
+	number := 0
+	negative := src[0] == '-'
+
+	start := 0
+	if negative {
+		start = 1
+	}
+
+	for i := start; i < len(src); i++ {
+
+		if src[i] < '0' || src[i] > '9' {
+			return 0, fmt.Errorf("Protocol error: invalid reply length '%s'", string(src))
+		}
+
+		number = number*10 + int(src[i]-'0')
+
+		if number > math.MaxInt32 {
+			return 0, fmt.Errorf("Protocol error: reply length '%s' out of range", string(src))
+		}
+	}
+
+	if negative {
+		return -number, nil
+	}
+
+	return number, nil
+}
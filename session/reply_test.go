@@ -0,0 +1,70 @@
+package session
+
+import "testing"
+
+// countReplies feeds the replies step bytes at a time and returns how many were complete
+func countReplies(t *testing.T, input string, step int) int {
+
+	p := newReplyParser()
+	count := 0
+
+	for start := 0; start < len(input); start += step {
+
+		end := start + step
+		if end > len(input) {
+			end = len(input)
+		}
+
+		chunk := []byte(input[start:end])
+
+		for len(chunk) > 0 {
+
+			used, complete, err := p.parse(chunk)
+
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			chunk = chunk[used:]
+
+			if complete {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func TestReplyParser(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		input string
+		want  int
+	}{
+		{"resp2", "+OK\r\n$5\r\nab\r\nc\r\n*2\r\n*2\r\n:1\r\n$-1\r\n*0\r\n-ERR x\r\n*3\r\n$1\r\n*\r\n+a*b\r\n*1\r\n$0\r\n\r\n", 5},
+		{"resp3", "%2\r\n+a\r\n:1\r\n+b\r\n~1\r\n,1.5\r\n|1\r\n+k\r\n#t\r\n_\r\n>3\r\n$7\r\nmessage\r\n$1\r\nc\r\n=8\r\ntxt:ab\r\n\r\n*2\r\n|1\r\n+x\r\n+y\r\n(123\r\n!3\r\nERR\r\n", 4},
+		{"nil array", "*-1\r\n+OK\r\n", 2},
+	}
+
+	for _, test := range tests {
+		for step := 1; step <= len(test.input); step++ {
+			if got := countReplies(t, test.input, step); got != test.want {
+				t.Fatalf("%s in reads of %d bytes: %d replies, want %d", test.name, step, got, test.want)
+			}
+		}
+	}
+}
+
+func TestReplyParserPush(t *testing.T) {
+
+	p := newReplyParser()
+	push := []byte(">2\r\n$7\r\nmessage\r\n$1\r\nc\r\n")
+
+	used, complete, err := p.parse(push)
+
+	if err != nil || !complete || used != len(push) || !p.wasPush() {
+		t.Fatalf("%d %v %v %v", used, complete, err, p.wasPush())
+	}
+}
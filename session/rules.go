@@ -0,0 +1,241 @@
+package session
+
+import (
+	"fmt"
+	"hargo/config"
+	"net"
+	"strings"
+)
+
+// Action is what a routing rule does with the commands it matches
+type Action int
+
+const (
+	// no rule matched: default routing
+	ActionNone Action = iota
+	ActionMaster
+	ActionSlave
+	ActionDeny
+	ActionNoCache
+)
+
+var actionNames = map[string]Action{
+	"master":  ActionMaster,
+	"slave":   ActionSlave,
+	"deny":    ActionDeny,
+	"nocache": ActionNoCache,
+}
+
+type rule struct {
+	command string
+	key     string
+	client  string
+	network *net.IPNet
+	action  Action
+}
+
+// Rules is the ordered list of user defined routing rules
+type Rules struct {
+	ruleList []*rule
+}
+
+// NewRules validates and compiles the rules from the configuration
+func NewRules(ruleList []config.Rule) (*Rules, error) {
+
+	r := &Rules{ruleList: make([]*rule, 0, len(ruleList))}
+
+	for index, src := range ruleList {
+
+		action, ok := actionNames[strings.ToLower(src.Action)]
+
+		if !ok {
+			return nil, fmt.Errorf("Rules: rule #%d has an unknown action '%s'", index, src.Action)
+		}
+
+		dst := &rule{command: strings.ToLower(src.Command), key: src.Key, client: src.Client, action: action}
+
+		// a client with a slash is a CIDR block, otherwise a glob on the IP
+		if strings.Contains(src.Client, "/") {
+
+			_, network, err := net.ParseCIDR(src.Client)
+
+			if err != nil {
+				return nil, fmt.Errorf("Rules: rule #%d has an invalid client network '%s' because %v", index, src.Client, err)
+			}
+
+			dst.network = network
+		}
+
+		r.ruleList = append(r.ruleList, dst)
+	}
+
+	return r, nil
+}
+
+// Match returns the action of the first rule matching the command, its keys and the client IP
+func (r *Rules) Match(name string, keys []string, clientIP net.IP) Action {
+
+	if len(r.ruleList) == 0 {
+		return ActionNone
+	}
+
+	name = strings.ToLower(name)
+
+	for _, rule := range r.ruleList {
+
+		if rule.command != "" && rule.command != name {
+			continue
+		}
+
+		if rule.client != "" && !rule.matchClient(clientIP) {
+			continue
+		}
+
+		if rule.key != "" && !rule.matchKeys(keys) {
+			continue
+		}
+
+		return rule.action
+	}
+
+	return ActionNone
+}
+
+func (r *rule) matchClient(clientIP net.IP) bool {
+
+	if clientIP == nil {
+		return false
+	}
+
+	if r.network != nil {
+		return r.network.Contains(clientIP)
+	}
+
+	return globMatch(r.client, clientIP.String())
+}
+
+func (r *rule) matchKeys(keys []string) bool {
+
+	for _, key := range keys {
+		if globMatch(r.key, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globMatch matches s against a redis style glob pattern: * ? [abc] [^a-z] and \ escapes
+func globMatch(pattern, s string) bool {
+
+	for len(pattern) > 0 {
+
+		switch pattern[0] {
+		case '*':
+
+			// consecutive stars are the same as one
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+
+		case '?':
+
+			if len(s) == 0 {
+				return false
+			}
+
+			s = s[1:]
+			pattern = pattern[1:]
+
+		case '[':
+
+			if len(s) == 0 {
+				return false
+			}
+
+			end := strings.IndexByte(pattern[1:], ']')
+
+			// no closing bracket: literal match
+			if end == -1 {
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				pattern = pattern[1:]
+				continue
+			}
+
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+
+			if negate {
+				class = class[1:]
+			}
+
+			if matchClass(class, s[0]) == negate {
+				return false
+			}
+
+			s = s[1:]
+			pattern = pattern[end+2:]
+
+		case '\\':
+
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+
+	return len(s) == 0
+}
+
+// matchClass returns true if c is in the bracket class (ranges like a-z included)
+func matchClass(class string, c byte) bool {
+
+	for i := 0; i < len(class); i++ {
+
+		if i+2 < len(class) && class[i+1] == '-' {
+
+			start, end := class[i], class[i+2]
+			if start > end {
+				start, end = end, start
+			}
+
+			if c >= start && c <= end {
+				return true
+			}
+
+			i += 2
+			continue
+		}
+
+		if class[i] == c {
+			return true
+		}
+	}
+
+	return false
+}
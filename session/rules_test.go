@@ -0,0 +1,65 @@
+package session
+
+import (
+	"hargo/config"
+	"net"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"session:*", "session:a/b", true},
+		{"session:*", "sess", false},
+		{"h?llo", "hello", true},
+		{"?", "", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"*", "", true},
+	}
+
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.s); got != test.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
+
+func TestRulesMatch(t *testing.T) {
+
+	rules, err := NewRules([]config.Rule{
+		{Key: "session:*", Action: "master"},
+		{Command: "keys", Action: "deny"},
+		{Client: "10.0.0.0/8", Action: "nocache"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		keys     []string
+		clientIP net.IP
+		want     Action
+	}{
+		{"GET", []string{"session:1"}, nil, ActionMaster},
+		{"KEYS", nil, nil, ActionDeny},
+		{"get", []string{"x"}, net.ParseIP("10.1.2.3"), ActionNoCache},
+		{"get", []string{"x"}, nil, ActionNone},
+	}
+
+	for _, test := range tests {
+		if got := rules.Match(test.name, test.keys, test.clientIP); got != test.want {
+			t.Errorf("Match(%s %v %v) = %v, want %v", test.name, test.keys, test.clientIP, got, test.want)
+		}
+	}
+}
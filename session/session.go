@@ -2,244 +2,774 @@ package session
 
 import (
 	"bytes"
+	"hargo/command"
 	"hargo/discovery"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// how long we wait for redis to reply
+	replyTimeout = 5 * time.Second
+)
+
 type CommandSession struct {
 	manager *Manager
 	client  net.Conn
 	isHA    bool
 	readBuf []byte
+	parser  *requestParser
+
+	// RESP version negotiated by the client with HELLO
+	protocol int
+
+	// database chosen by the client with SELECT
+	db int
+
+	// used to match the routing rules
+	clientIP net.IP
+
+	// proxy user the client authenticated as (nil if not authenticated)
+	user *User
+
+	// keeps reads on the master right after a write
+	consistency *readYourWrites
+
+	// shard of the current batch
+	discov *discovery.Discovery
+
+	// MULTI / WATCH state and pinned connection
+	tx transaction
+
+	// dedicated connections of a client in pub/sub mode, by shard (nil otherwise)
+	subs map[*discovery.Discovery]*subscriber
+
+	// the subscriber streams messages to the client while the session writes replies
+	writeMutex sync.Mutex
+
+	// master connection of the blocking commands, kept across them
+	blocker *discovery.ConnWrapper
+	// client data read while it was blocked, not parsed yet
+	pendingInput []byte
 }
 
 func (c *CommandSession) Handle() {
 
+	// a client leaving mid-transaction must not leave a dirty connection in the pool
+	defer c.abortTransaction()
+	defer c.unsubscribeAll()
+	defer c.closeBlocker()
+
 	for {
 
 		//log.Printf("readBuf: len %d, cap %d\n", len(readBuf), cap(readBuf))
 
-		read, err := c.client.Read(c.readBuf)
+		input := c.pendingInput
+		c.pendingInput = nil
 
-		if err != nil {
-			//log.Printf("handleConnection: read error: %v", err)
-			break
+		// what the client sent while blocked comes first
+		if len(input) == 0 {
+
+			read, err := c.client.Read(c.readBuf)
+
+			if err != nil {
+				//log.Printf("handleConnection: read error: %v", err)
+				break
+			}
+
+			input = c.readBuf[0:read]
 		}
 
-		//log.Printf("Incoming: '%s'\n", string(c.readBuf[0:read]))
+		//log.Printf("Incoming: '%s'\n", string(input))
 
-		commandList, err := readRequest(c.readBuf[0:read])
+		// a protocol error can't be recovered from (we don't know where the next command starts):
+		// what was read before it is served, then the client gets the error and is disconnected
+		protocolErr := c.parser.feed(input)
 
-		if err != nil {
-			log.Printf("Unable to read command because: %v", err)
-			break
+		// we collect every complete command, partial ones stay buffered until the next read
+		reqList := make([]*request, 0, 1)
+
+		for protocolErr == nil {
+
+			req, err := c.parser.next()
+
+			if err != nil {
+				protocolErr = err
+				break
+			}
+
+			if req == nil {
+				break
+			}
+
+			//log.Printf("We got: '%s'", strings.Join(req.args, " / "))
+
+			reqList = append(reqList, req)
 		}
 
-		//log.Printf("We got: '%s'", strings.Join(strList, " / "))
+		if len(reqList) == 0 && protocolErr == nil {
+			continue
+		}
 
-		if _, ok := slaveSafeCommandMap[strings.ToLower(commandList[0])]; ok {
-			c.isHA = false
-		} else {
-			c.isHA = true
+		out := &bytes.Buffer{}
+
+		c.dispatch(reqList, out)
+
+		if protocolErr != nil {
+			log.Printf("Unable to read command because: %v", protocolErr)
+			writeError(out, protocolErr)
 		}
 
-		// if we have no slaves all requests go to the master
-		if c.manager.discov.SlavesSignature() == "" {
-			c.isHA = true
+		// all the replies for this read are written back with one call
+		if err := c.writeClient(out.Bytes()); err != nil || protocolErr != nil {
+			c.client.Close()
+			return
 		}
+	}
+}
+
+// describe looks the request up in the command table
+func (c *CommandSession) describe(req *request) {
 
-		c.sendAndReceive(c.readBuf[0:read])
+	req.name = strings.ToLower(req.args[0])
+	req.info = c.manager.shards.Default().Commands().Lookup(req.name)
+
+	if req.info != nil {
+		req.keys = req.info.Keys(req.args)
 	}
 }
 
-func (c *CommandSession) sendAndReceive(src []byte) {
+// route returns true if the request has to be sent to the master
+func (c *CommandSession) route(req *request, action Action) bool {
 
-	var redis *discovery.ConnWrapper
-	var command string = string(src) // requests are generally very small
+	// if we have no slaves all requests go to the master
+	if req.shard.SlavesSignature() == "" {
+		return true
+	}
 
-	if bufferedResp := c.manager.cache.Get(command); bufferedResp != nil {
+	switch action {
+	case ActionMaster:
+		return true
+	case ActionSlave:
+		// a slave would refuse a write, whatever the rules say
+		if req.info != nil && req.info.IsReadOnly() {
+			return false
+		}
+	}
 
-		//log.Printf("Serving cache reply for '%s'\n", command)
+	// unknown commands are sent to the master, just in case
+	if req.info == nil {
+		return true
+	}
 
-		var servedSoFar = 0
+	return !req.info.IsReadOnly()
+}
 
-		for servedSoFar < len(bufferedResp) {
+// locate finds the shard of the request from its keys: the shard of the transaction while it lasts,
+// the default shard for commands without keys and for pub/sub (but the shard channels of redis cluster)
+func (c *CommandSession) locate(req *request) error {
 
-			// we time out after 5 seconds (client side)
-			c.client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	shards := c.manager.shards
 
-			// we write back to the client
-			written, err := c.client.Write(bufferedResp[servedSoFar:])
+	if req.info != nil && req.info.Has(command.PubSub) && (!shards.Clustered() || len(req.keys) == 0) {
+		req.shard = shards.Default()
+		return nil
+	}
 
-			servedSoFar += written
+	// commands about every key: on every shard, or refused
+	if len(req.keys) == 0 && shards.Len() > 1 && (broadcastCommands[req.name] || unshardableCommands[req.name]) {
 
-			if err != nil {
-				log.Printf("Unable to write response to the client because: %v", err)
-				c.client.Close()
-				break
-			}
+		if unshardableCommands[req.name] || c.tx.active() || c.tx.deferred {
+			return newReplyError("CROSSSLOT", "'"+req.name+"' can't run across several shards")
 		}
 
-		// we've served a cached reply
-		return
+		req.fanOut = true
+		return nil
 	}
 
-	if c.isHA {
-		redis = c.manager.discov.GetMaster()
-	} else {
-		redis = c.manager.discov.GetSlave()
+	shard, ok := shards.ForKeys(req.keys)
+
+	if !ok {
+
+		// a few multi-key commands can be split, unless they are part of a transaction
+		if splittable(req) && !c.tx.active() && !c.tx.deferred {
+			req.fanOut = true
+			return nil
+		}
+
+		return newReplyError("CROSSSLOT", "Keys of '"+req.name+"' belong to different shards and the command can't be split")
 	}
 
-	defer func(redis *discovery.ConnWrapper) {
-		if c.isHA {
-			c.manager.discov.ReturnMaster(redis)
-		} else {
-			c.manager.discov.ReturnSlave(redis)
+	if c.tx.active() {
+
+		if len(req.keys) > 0 && shard != c.tx.discov {
+			return newReplyError("CROSSSLOT", "Keys in request don't hash to the shard of the transaction")
 		}
-	}(redis)
 
-	// we write to the redis conn
-	writtenSoFar := 0
+		shard = c.tx.discov
+	}
 
-	for writtenSoFar < len(src) {
+	req.shard = shard
 
-		// we time out after 10 seconds
-		redis.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return nil
+}
 
-		//log.Printf("Sending '%s'\n", string(src))
+// dispatch routes every request on its own and appends the replies to out in the original order.
+// Consecutive requests going to the same place are pipelined to redis in one go
+func (c *CommandSession) dispatch(reqList []*request, out *bytes.Buffer) {
 
-		written, err := redis.Write(src)
+	batch := make([]*request, 0, len(reqList))
 
-		if err != nil {
-			log.Printf("Unable to send commmand to redis because: %v", err)
-			c.client.Close()
+	flush := func() {
+
+		if len(batch) == 0 {
 			return
 		}
 
-		writtenSoFar += written
+		c.sendAndReceive(batch, out)
+		batch = batch[0:0]
 	}
 
-	//log.Printf("readBuf2: len %d, cap %d\n", len(readBuf), cap(readBuf))
+	for _, req := range reqList {
 
-	// we reinit the counter (0 = message complete)
-	cnt := 0
+		c.describe(req)
 
-	// we allocate a buffer for the reply
-	respBuffer := &bytes.Buffer{}
-	respBuffer.Grow(4096) // at least 4kb
+		// the proxy authenticates its clients itself, after the replies of the requests before
+		if req.name == "auth" {
+			flush()
+			c.auth(req, out)
+			continue
+		}
 
-	for {
+		// HELLO changes the protocol of the following replies so it goes on its own
+		if req.name == "hello" {
+			flush()
+			c.discov = c.manager.shards.Default()
+			c.hello(req, out)
+			continue
+		}
 
-		// we time out after 5 seconds
-		redis.SetReadDeadline(time.Now().Add(5 * time.Second))
+		// nothing goes further for a client that is not authenticated or not allowed to
+		if err := c.authorize(req); err != nil {
+			flush()
+			writeError(out, err)
+			continue
+		}
 
-		read, err := redis.Read(c.readBuf)
+		// RESET is answered by the proxy: forwarded, it would log the pooled connection out
+		if req.name == "reset" {
+			flush()
+			c.reset(out)
+			continue
+		}
+
+		action := c.manager.rules.Match(req.name, req.keys, c.clientIP)
+
+		if action == ActionDeny {
+			flush()
+			writeError(out, newReplyError("ERR", "Command '"+req.name+"' denied by the proxy routing rules"))
+			continue
+		}
+
+		if err := c.locate(req); err != nil {
+			flush()
+			writeError(out, err)
+			continue
+		}
+
+		// a MULTI held back is sent with the first command that has keys, which tells the shard of the
+		// transaction (SELECT is refused further down)
+		if c.tx.deferred && req.name != "select" {
+
+			flush()
+
+			switch {
+			case req.name == "discard":
+				c.tx.deferred = false
+				c.tx.held = nil
+				out.WriteString("+OK\r\n")
+				continue
+
+			case req.name == "multi":
+				writeError(out, newReplyError("ERR", "MULTI calls can not be nested"))
+				continue
+
+			// the commands without keys wait with it, redis would only queue them anyway
+			case len(req.keys) == 0 && req.name != "exec":
+				c.consistency.wrote(req)
+				c.tx.held = append(c.tx.held, req)
+				out.WriteString("+QUEUED\r\n")
+				continue
+			}
+
+			if err := c.beginDeferred(req.shard); err != nil {
+				writeError(out, err)
+				continue
+			}
+		}
+
+		// multi-key commands spread across shards go to every shard involved
+		if req.fanOut {
+			flush()
+			c.consistency.wrote(req)
+			c.fanOut(req, action, out)
+			continue
+		}
+
+		if c.subscribing(req) {
+
+			flush()
+
+			// the subscriber writes its replies itself, what we have so far must go out first
+			if err := c.writeClient(out.Bytes()); err != nil {
+				return
+			}
+			out.Reset()
+
+			if err := c.subscribe(req); err != nil {
+				log.Printf("Unable to send pub/sub command because: %v", err)
+				writeError(out, err)
+			}
+			continue
+		}
+
+		// the client left pub/sub mode, what follows goes the usual way
+		if len(c.subs) > 0 && c.subscriptionCount() == 0 {
+			flush()
+			c.leavePubSub()
+		}
+
+		// SELECT changes the database of the following commands so it goes on its own
+		if req.name == "select" {
+			flush()
+			c.discov = req.shard
+			c.selectDB(req, out)
+			continue
+		}
+
+		// transactions stick to a single master connection
+		if startsTransaction(req.name) && !c.tx.active() {
+
+			flush()
+
+			// with several shards MULTI waits for the first command to tell where the transaction goes
+			if req.name == "multi" && c.manager.shards.Len() > 1 {
+				c.tx.deferred = true
+				out.WriteString("+OK\r\n")
+				continue
+			}
+
+			c.pin(req.shard)
+		}
+
+		// blocking commands wait on their own connection (inside a transaction they are just queued),
+		// WAIT and WAITAOF follow the writes on theirs
+		if timeout, ok := blockingTimeout(req); ok && !waiting(req) && !c.tx.active() {
+			flush()
+			c.discov = req.shard
+			c.consistency.wrote(req)
+			c.block(req, timeout, out)
+			continue
+		}
+
+		isHA := c.route(req, action) || c.tx.active()
+
+		// a read following a write of the same session must see it (explicit rules come first)
+		if !isHA && action == ActionNone && c.consistency.mustReadMaster(req) {
+			isHA = true
+		}
+
+		if isHA {
+			c.consistency.wrote(req)
+		}
+
+		// only slave replies are cached
+		req.cacheable = !isHA && action != ActionNoCache && req.info != nil && req.info.IsCacheable()
+
+		if req.cacheable {
+
+			if bufferedResp := c.manager.cache.Get(c.cacheKey(req)); bufferedResp != nil {
+
+				//log.Printf("Serving cache reply for '%s'\n", string(req.raw))
+
+				// whatever was queued before must be answered first
+				flush()
+
+				out.Write(bufferedResp)
+				continue
+			}
+		}
+
+		// a change of destination closes the current pipeline
+		if len(batch) > 0 && (isHA != c.isHA || req.shard != c.discov) {
+			flush()
+		}
+
+		c.isHA = isHA
+		c.discov = req.shard
+		batch = append(batch, req)
+
+		// the connection is released once the transaction is over
+		if c.tx.active() {
+
+			c.tx.update(req.name)
+
+			if c.tx.done() {
+				flush()
+				c.unpin()
+			}
+		}
+	}
+
+	flush()
+}
+
+// hello forwards HELLO to the master and keeps track of the protocol version the client negotiated
+func (c *CommandSession) hello(req *request, out *bytes.Buffer) {
+
+	protocol := c.protocol
+
+	req, err := c.helloAuth(req)
+
+	if err != nil {
+		writeError(out, err)
+		return
+	}
+
+	if len(req.args) > 1 {
+
+		version, err := strconv.Atoi(req.args[1])
 
 		if err != nil {
-			log.Printf("Unable to read response from redis because: %v", err)
+			writeError(out, newReplyError("ERR", "Protocol version is not an integer or out of range"))
 			return
 		}
 
-		//log.Printf("Redis reply: '%s'", strings.Trim(string(c.readBuf[0:read]), "\n\r"))
+		if version != 2 && version != 3 {
+			writeError(out, newReplyError("NOPROTO", "unsupported protocol version"))
+			return
+		}
+
+		protocol = version
+	}
+
+	start := out.Len()
+
+	c.isHA = true
+
+	redis, release := c.checkout()
+	defer release()
+
+	if err := c.roundTrip(redis, []*request{req}, out); err != nil {
+		return
+	}
+
+	// the connection switched only if redis agreed
+	if out.Len() > start && out.Bytes()[start] != '-' {
+		c.protocol = protocol
+		redis.SetProtocol(protocol)
+
+		for _, sub := range c.subs {
+			sub.setProtocol(protocol)
+		}
+	}
+}
+
+// cacheKey returns the cache key of a request: replies are cached per database and protocol version
+func (c *CommandSession) cacheKey(req *request) string {
+
+	key := string(req.raw)
+
+	if c.db != 0 {
+		key = "db" + strconv.Itoa(c.db) + ":" + key
+	}
+
+	if c.protocol != 2 {
+		key = strconv.Itoa(c.protocol) + ":" + key
+	}
+
+	return key
+}
+
+// writeClient writes the whole src back to the client
+func (c *CommandSession) writeClient(src []byte) error {
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 
-		// we fast parse the message to see if it's complete
-		cnt = fastParse(c.readBuf[0:read], cnt)
+	var servedSoFar = 0
+
+	for servedSoFar < len(src) {
 
 		// we time out after 5 seconds (client side)
 		c.client.SetWriteDeadline(time.Now().Add(5 * time.Second))
 
-		// we save to the buffer
-		respBuffer.Write(c.readBuf[0:read])
-
 		// we write back to the client
-		_, err = c.client.Write(c.readBuf[0:read])
+		written, err := c.client.Write(src[servedSoFar:])
+
+		servedSoFar += written
 
 		if err != nil {
 			log.Printf("Unable to write response to the client because: %v", err)
-			c.client.Close()
-			return
+			return err
 		}
+	}
 
-		// the message was served complete (no need to read again)
-		if cnt == 0 {
-			break
-		} else {
-			log.Printf("Partial reply: cnt %d => '%s'", cnt, string(c.readBuf[0:read]))
+	return nil
+}
+
+// sendAndReceive pipelines the batch to a single redis connection and appends the replies to out.
+// Failures are reported to the client as error replies
+func (c *CommandSession) sendAndReceive(batch []*request, out *bytes.Buffer) {
+
+	redis, release := c.checkout()
+	defer release()
+
+	if err := c.switchProtocol(redis); err != nil {
+		writeErrors(out, batch, err)
+		return
+	}
+
+	if err := c.switchDB(redis); err != nil {
+		writeErrors(out, batch, err)
+		return
+	}
+
+	start := time.Now()
+
+	err := c.roundTrip(redis, batch, out)
+
+	// redis cluster may have moved some of the keys (transactions get the redirections in EXEC)
+	if err == nil && c.manager.shards.Clustered() && !c.tx.active() {
+		c.followRedirections(batch, out)
+	}
+
+	if err == nil {
+		c.afterBatch(batch, out)
+	}
+
+	if err == nil && !c.isHA {
+		c.discov.ObserveLatency(redis, time.Since(start))
+	}
+
+	// the dropped connection took the transaction with it
+	if err != nil && c.tx.active() {
+		c.unpin()
+	}
+}
+
+// switchProtocol makes the connection speak the same protocol as the client
+func (c *CommandSession) switchProtocol(redis *discovery.ConnWrapper) error {
+
+	if redis.Protocol() == c.protocol {
+		return nil
+	}
+
+	hello := &request{args: []string{"HELLO", strconv.Itoa(c.protocol)}}
+	hello.raw = formatCommand(hello.args)
+
+	helloOut := &bytes.Buffer{}
+
+	if err := c.roundTrip(redis, []*request{hello}, helloOut); err != nil {
+		return err
+	}
+
+	if helloOut.Len() > 0 && helloOut.Bytes()[0] == '-' {
+		return newReplyError("ERR", "Unable to switch the redis connection to RESP"+strconv.Itoa(c.protocol))
+	}
+
+	redis.SetProtocol(c.protocol)
+
+	return nil
+}
+
+// checkout returns the connection the current batch goes to and the function giving it back:
+// the pinned connection during a transaction, a slave or the master otherwise
+func (c *CommandSession) checkout() (*discovery.ConnWrapper, func()) {
+
+	if c.tx.active() {
+		return c.tx.conn, func() {}
+	}
+
+	redis, release, isHA := checkoutFrom(c.discov, c.isHA)
+	c.isHA = isHA
+
+	return redis, release
+}
+
+// checkoutFrom returns a connection of the shard (to a slave unless isHA), the function giving it back
+// and whether it goes to the master
+func checkoutFrom(discov *discovery.Discovery, isHA bool) (*discovery.ConnWrapper, func(), bool) {
+
+	var redis *discovery.ConnWrapper
+
+	if !isHA {
+		redis = discov.GetSlave()
+
+		// no slave is fit to serve reads, the master takes over
+		if redis == nil {
+			isHA = true
 		}
 	}
 
-	// we cache the reply if it's not HA
-	if !c.isHA {
-		c.manager.cache.Put(command, respBuffer.Bytes())
+	if isHA {
+		redis = discov.GetMaster()
+		return redis, func() { discov.ReturnMaster(redis) }, true
 	}
+
+	return redis, func() { discov.ReturnSlave(redis) }, false
+}
+
+// roundTrip pipelines the batch to redis and appends the replies to out. Push messages received
+// in the meantime are forwarded as well. On failure the requests left unanswered get an error reply,
+// the connection is dropped (it may still carry late replies) and the error is returned
+func (c *CommandSession) roundTrip(redis *discovery.ConnWrapper, batch []*request, out *bytes.Buffer) error {
+	return c.roundTripWithin(redis, batch, out, batchTimeout(batch))
 }
 
-func fastParse(src []byte, cnt int) int {
+// roundTripWithin is roundTrip waiting up to readTimeout for each read (0 waits forever)
+func (c *CommandSession) roundTripWithin(redis *discovery.ConnWrapper, batch []*request, out *bytes.Buffer, readTimeout time.Duration) error {
+
+	if err := c.send(redis, batch, out); err != nil {
+		return err
+	}
 
-	for i := 0; i < len(src); i++ {
+	return c.receive(redis, batch, out, readTimeout)
+}
 
-		switch src[i] {
-		case '*': // array
+// send is the first half of roundTrip: the batch is written to redis, on failure every request
+// gets an error reply
+func (c *CommandSession) send(redis *discovery.ConnWrapper, batch []*request, out *bytes.Buffer) error {
 
-			length := int(0)
+	// we join the commands (requests are generally very small)
+	src := batch[0].raw
 
-			j := 1
-			for j = 1; src[i+j] != '\r'; j++ {
-				length = length*10 + int(src[i+j]-'0')
-			}
+	if len(batch) > 1 {
+		src = make([]byte, 0, len(batch)*len(batch[0].raw))
+		for _, req := range batch {
+			src = append(src, req.raw...)
+		}
+	}
 
-			// we skip the final '\n' + the length of the bulk number string
-			i += j + 1
+	// we write to the redis conn
+	writtenSoFar := 0
+
+	for writtenSoFar < len(src) {
 
-			// we increment the counter for each item in the array
-			cnt += length
+		// we time out after 10 seconds
+		redis.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
-		case '$': // bulk string
+		//log.Printf("Sending '%s'\n", string(src))
 
-			// nil bulk string
-			if src[i+1] == '-' && src[i+2] == '1' {
-				i += 2
-				cnt++
-				continue
-			}
+		written, err := redis.Write(src[writtenSoFar:])
 
-			length := int(0)
+		if err != nil {
+			log.Printf("Unable to send commmand to redis because: %v", err)
 
-			// we read the number of items in the array (which should arrive in one go)
-			j := 1
-			for j = 1; src[i+j] != '\r'; j++ {
-				length = length*10 + int(src[i+j]-'0')
-				//log.Printf("j: %d / src[i+j]: '%c' length: %d\n", j, src[i+j], length)
+			// once part of the pipeline went through we can't tell what ran
+			replyErr := sendError(err)
+			if writtenSoFar+written > 0 {
+				replyErr = receiveError(err)
 			}
 
-			// we skip the final '\n' + the length of the bulk number string
-			i += j + 1
+			redis.Disconnect()
+			writeErrors(out, batch, replyErr)
+			return replyErr
+		}
+
+		writtenSoFar += written
+	}
+
+	return nil
+}
+
+// receive is the second half of roundTrip: the replies to the batch are read from redis
+func (c *CommandSession) receive(redis *discovery.ConnWrapper, batch []*request, out *bytes.Buffer, readTimeout time.Duration) error {
+
+	// we follow the replies to know where each one ends
+	parser := newReplyParser()
+
+	// we allocate a buffer for the current reply
+	respBuffer := &bytes.Buffer{}
+	respBuffer.Grow(4096) // at least 4kb
+
+	// index of the request the current reply belongs to
+	replied := 0
+
+	for replied < len(batch) {
+
+		if readTimeout > 0 {
+			redis.SetReadDeadline(time.Now().Add(readTimeout))
+		} else {
+			redis.SetReadDeadline(time.Time{})
+		}
+
+		read, err := redis.Read(c.readBuf)
+
+		if err != nil {
+			log.Printf("Unable to read response from redis because: %v", err)
+
+			redis.Disconnect()
+			writeErrors(out, batch[replied:], receiveError(err))
+			return err
+		}
+
+		//log.Printf("Redis reply: '%s'", strings.Trim(string(c.readBuf[0:read]), "\n\r"))
+
+		chunk := c.readBuf[0:read]
+
+		// one read may carry the end of a reply and the beginning of the next one
+		for len(chunk) > 0 && replied < len(batch) {
+
+			used, complete, err := parser.parse(chunk)
+
+			if err != nil {
+				log.Printf("Unable to parse response from redis because: %v", err)
 
-			// we skip the bulk string
-			i += length
+				// a half written reply can't be fixed, the client gets the error instead
+				redis.Disconnect()
+				respBuffer.Reset()
+				writeErrors(out, batch[replied:], newReplyError("ERR", "Invalid reply from redis"))
+				return err
+			}
 
-			cnt++
+			// we save to the buffer
+			respBuffer.Write(chunk[0:used])
+			chunk = chunk[used:]
 
-		case '-':
-			log.Printf("Error returned!")
+			if !complete {
+				continue
+			}
 
-			cnt++
-		case '+', ':': // string, error or number
+			// out of band push messages don't answer any command
+			if parser.wasPush() {
+				out.Write(respBuffer.Bytes())
+				respBuffer.Reset()
+				continue
+			}
 
-			cnt++
-		case '\r':
+			// the reply is complete
+			batch[replied].replyStart = out.Len()
+			out.Write(respBuffer.Bytes())
+			batch[replied].replyEnd = out.Len()
 
-			if i+1 < len(src) && src[i+1] == '\n' {
-				cnt--
-				i++
+			// redirections are not the value of the key
+			if batch[replied].cacheable && !isRedirection(respBuffer.Bytes()) {
+				c.manager.cache.Put(c.cacheKey(batch[replied]), append([]byte(nil), respBuffer.Bytes()...))
 			}
-		default:
-			// do nothing
+
+			respBuffer.Reset()
+			replied++
+		}
+
+		if len(chunk) > 0 {
+			log.Printf("Discarding %d unexpected bytes from redis", len(chunk))
 		}
 	}
 
-	return cnt
+	return nil
 }
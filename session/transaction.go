@@ -0,0 +1,156 @@
+package session
+
+import (
+	"bytes"
+	"hargo/discovery"
+	"log"
+)
+
+// transaction pins a master connection to the session from MULTI or WATCH until EXEC, DISCARD
+// or UNWATCH, so that all the commands of a transaction run on the same redis connection
+type transaction struct {
+	conn     *discovery.ConnWrapper
+	discov   *discovery.Discovery
+	inMulti  bool
+	watching bool
+
+	// MULTI answered but not sent yet: the shard of the transaction is not known
+	deferred bool
+	// commands without keys answered QUEUED while the MULTI is held back
+	held []*request
+}
+
+// active returns true if the session holds a pinned connection
+func (t *transaction) active() bool {
+	return t.conn != nil
+}
+
+// startsTransaction returns true if the command needs a pinned connection
+func startsTransaction(name string) bool {
+	return name == "multi" || name == "watch"
+}
+
+// update follows the transaction state once the command has been sent
+func (t *transaction) update(name string) {
+
+	switch name {
+	case "multi":
+		t.inMulti = true
+	case "watch":
+		// WATCH inside MULTI is refused by redis
+		if !t.inMulti {
+			t.watching = true
+		}
+	case "exec", "discard":
+		t.inMulti = false
+		t.watching = false
+	case "unwatch":
+		// UNWATCH inside MULTI is just queued
+		if !t.inMulti {
+			t.watching = false
+		}
+	}
+}
+
+// done returns true when the pinned connection is no longer needed
+func (t *transaction) done() bool {
+	return !t.inMulti && !t.watching
+}
+
+// pin checks out a master connection of the shard for the transaction
+func (c *CommandSession) pin(shard *discovery.Discovery) {
+	c.tx.discov = shard
+	c.tx.conn = shard.GetMaster()
+}
+
+// beginDeferred pins a connection of the shard and sends the MULTI and the commands the client already
+// got a reply for. Their replies are dropped: a command redis refuses makes EXEC fail with EXECABORT
+func (c *CommandSession) beginDeferred(shard *discovery.Discovery) error {
+
+	c.tx.deferred = false
+
+	c.pin(shard)
+
+	multi := &request{args: []string{"MULTI"}}
+	multi.raw = formatCommand(multi.args)
+
+	batch := append([]*request{multi}, c.tx.held...)
+	c.tx.held = nil
+
+	multiOut := &bytes.Buffer{}
+
+	// the connection is switched before the transaction starts
+	err := c.switchProtocol(c.tx.conn)
+
+	if err == nil {
+		err = c.switchDB(c.tx.conn)
+	}
+
+	if err == nil {
+		err = c.roundTrip(c.tx.conn, batch, multiOut)
+	}
+
+	if err == nil && multi.replyEnd > multi.replyStart && multiOut.Bytes()[multi.replyStart] == '-' {
+		err = newReplyError("ERR", "Unable to start the transaction: "+string(bytes.TrimSpace(multiOut.Bytes()[multi.replyStart+1:multi.replyEnd])))
+	}
+
+	if err != nil {
+		c.unpin()
+		return err
+	}
+
+	c.tx.update("multi")
+
+	return nil
+}
+
+// unpin gives the transaction connection back to the pool
+func (c *CommandSession) unpin() {
+
+	if c.tx.conn == nil {
+		return
+	}
+
+	c.tx.discov.ReturnMaster(c.tx.conn)
+
+	c.tx.conn = nil
+	c.tx.discov = nil
+	c.tx.inMulti = false
+	c.tx.watching = false
+}
+
+// abortTransaction cleans up the pinned connection of a client that went away mid-transaction:
+// the queued commands are discarded and the watched keys forgotten before it goes back to the pool
+func (c *CommandSession) abortTransaction() {
+
+	c.tx.deferred = false
+	c.tx.held = nil
+
+	if !c.tx.active() {
+		return
+	}
+
+	resetList := make([]*request, 0, 2)
+
+	if c.tx.inMulti {
+		resetList = append(resetList, &request{args: []string{"DISCARD"}})
+	}
+
+	if c.tx.watching {
+		resetList = append(resetList, &request{args: []string{"UNWATCH"}})
+	}
+
+	for _, req := range resetList {
+		req.raw = formatCommand(req.args)
+	}
+
+	if len(resetList) > 0 {
+
+		// on failure the connection is dropped, which resets it as well
+		if err := c.roundTrip(c.tx.conn, resetList, &bytes.Buffer{}); err != nil {
+			log.Printf("Unable to reset the transaction connection because: %v", err)
+		}
+	}
+
+	c.unpin()
+}
@@ -0,0 +1,290 @@
+package session
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"hargo/command"
+	"hargo/config"
+	"strings"
+)
+
+// defaultUser is the user AUTH <password> authenticates as, a default user without password
+// is given to every new client (the same as redis)
+const defaultUser = "default"
+
+// User is a client account of the proxy and what it may do
+type User struct {
+	name       string
+	password   string
+	categories []string
+	keys       []string
+	readOnly   bool
+}
+
+// Users are the client accounts of the proxy
+type Users struct {
+	userMap map[string]*User
+}
+
+// NewUsers validates the users from the configuration, nil if there is none (no authentication)
+func NewUsers(userList []config.User) (*Users, error) {
+
+	if len(userList) == 0 {
+		return nil, nil
+	}
+
+	u := &Users{userMap: make(map[string]*User, len(userList))}
+
+	for index, src := range userList {
+
+		if src.Name == "" {
+			return nil, fmt.Errorf("Users: user #%d has no name", index)
+		}
+
+		if _, ok := u.userMap[src.Name]; ok {
+			return nil, fmt.Errorf("Users: user '%s' is defined twice", src.Name)
+		}
+
+		for _, category := range src.Categories {
+			if !command.IsCategory(category) {
+				return nil, fmt.Errorf("Users: user '%s' has an unknown category '%s'", src.Name, category)
+			}
+		}
+
+		u.userMap[src.Name] = &User{name: src.Name, password: src.Password, categories: src.Categories, keys: src.Keys, readOnly: src.ReadOnly}
+	}
+
+	return u, nil
+}
+
+// initial returns the user a new client starts with: the default user if it has no password, nil otherwise
+func (u *Users) initial() *User {
+
+	if user, ok := u.userMap[defaultUser]; ok && user.password == "" {
+		return user
+	}
+
+	return nil
+}
+
+// authenticate returns the user matching the credentials, nil if there is none
+func (u *Users) authenticate(name, password string) *User {
+
+	user, ok := u.userMap[name]
+
+	if !ok || subtle.ConstantTimeCompare([]byte(user.password), []byte(password)) != 1 {
+		return nil
+	}
+
+	return user
+}
+
+// scriptCommands run scripts that may write, or manage the scripts. None of them has the write flag
+var scriptCommands = map[string]bool{
+	"eval":     true,
+	"evalsha":  true,
+	"fcall":    true,
+	"script":   true,
+	"function": true,
+}
+
+// readOnlyScriptCommands run scripts that only read
+var readOnlyScriptCommands = map[string]bool{
+	"eval_ro":    true,
+	"evalsha_ro": true,
+	"fcall_ro":   true,
+}
+
+// keyspaceCommands reach every key of the database without naming any
+var keyspaceCommands = map[string]bool{
+	"flushall":  true,
+	"flushdb":   true,
+	"swapdb":    true,
+	"keys":      true,
+	"scan":      true,
+	"randomkey": true,
+}
+
+// sortsByPattern returns true if SORT reads other keys through its BY or GET patterns
+func sortsByPattern(req *request) bool {
+
+	if req.name != "sort" && req.name != "sort_ro" {
+		return false
+	}
+
+	for k := 2; k < len(req.args)-1; k++ {
+
+		switch strings.ToLower(req.args[k]) {
+		case "by", "get":
+			return true
+		case "store":
+			k++
+		case "limit":
+			k += 2
+		}
+	}
+
+	return false
+}
+
+// authorize returns an error if the user is not allowed to run the request
+func (user *User) authorize(req *request) error {
+
+	denied := newReplyError("NOPERM", "User "+user.name+" has no permissions to run the '"+req.name+"' command")
+
+	// unknown commands can't be checked
+	if req.info == nil {
+		if user.readOnly || len(user.categories) > 0 {
+			return denied
+		}
+		return nil
+	}
+
+	// administration commands change the server itself (CONFIG SET, SHUTDOWN, REPLICAOF...)
+	if user.readOnly && (req.info.Has(command.Write) || req.info.Has(command.Admin) || scriptCommands[req.name]) {
+		return denied
+	}
+
+	// a script reaches any key, whatever the keys it declares, and so do the keyspace-wide commands
+	// and the patterns of SORT
+	if len(user.keys) > 0 && (scriptCommands[req.name] || readOnlyScriptCommands[req.name] || keyspaceCommands[req.name] || sortsByPattern(req)) {
+		return denied
+	}
+
+	if len(user.categories) > 0 {
+
+		allowed := false
+
+		for _, category := range user.categories {
+			if req.info.InCategory(category) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return denied
+		}
+	}
+
+	if len(user.keys) > 0 {
+
+		for _, key := range req.keys {
+
+			allowed := false
+
+			for _, pattern := range user.keys {
+				if globMatch(pattern, key) {
+					allowed = true
+					break
+				}
+			}
+
+			if !allowed {
+				return newReplyError("NOPERM", "No permissions to access a key")
+			}
+		}
+	}
+
+	return nil
+}
+
+// authorize returns an error if the client can't run the request: not authenticated or not allowed
+func (c *CommandSession) authorize(req *request) error {
+
+	if c.manager.users == nil {
+		return nil
+	}
+
+	if c.user == nil {
+
+		if req.name == "quit" {
+			return nil
+		}
+
+		return newReplyError("NOAUTH", "Authentication required.")
+	}
+
+	return c.user.authorize(req)
+}
+
+// login checks the credentials against the proxy users, the client keeps its current user on failure
+func (c *CommandSession) login(name, password string) error {
+
+	if c.manager.users == nil {
+		return newReplyError("ERR", "AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	user := c.manager.users.authenticate(name, password)
+
+	if user == nil {
+		return newReplyError("WRONGPASS", "invalid username-password pair or user is disabled.")
+	}
+
+	c.user = user
+
+	return nil
+}
+
+// auth answers AUTH [username] password, it never reaches redis (the proxy has its own credentials)
+func (c *CommandSession) auth(req *request, out *bytes.Buffer) {
+
+	var err error
+
+	switch len(req.args) {
+	case 2:
+		err = c.login(defaultUser, req.args[1])
+	case 3:
+		err = c.login(req.args[1], req.args[2])
+	default:
+		err = newReplyError("ERR", "wrong number of arguments for 'auth' command")
+	}
+
+	if err != nil {
+		writeError(out, err)
+		return
+	}
+
+	out.WriteString("+OK\r\n")
+}
+
+// helloAuth handles the AUTH option of HELLO and returns the request to forward without it
+func (c *CommandSession) helloAuth(req *request) (*request, error) {
+
+	args := make([]string, 0, len(req.args))
+	authenticated := false
+
+	for k := 0; k < len(req.args); k++ {
+
+		if k >= 2 && strings.ToLower(req.args[k]) == "auth" {
+
+			if k+2 >= len(req.args) {
+				return nil, newReplyError("ERR", "Syntax error in HELLO option 'auth'")
+			}
+
+			if err := c.login(req.args[k+1], req.args[k+2]); err != nil {
+				return nil, err
+			}
+
+			authenticated = true
+			k += 2
+			continue
+		}
+
+		args = append(args, req.args[k])
+	}
+
+	if c.manager.users != nil && c.user == nil {
+		return nil, newReplyError("NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	if !authenticated {
+		return req, nil
+	}
+
+	stripped := &request{args: args, name: req.name, info: req.info}
+	stripped.raw = formatCommand(args)
+
+	return stripped, nil
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"hargo/config"
+	"testing"
+)
+
+func TestUsersAuthenticate(t *testing.T) {
+
+	users, err := NewUsers([]config.User{{Name: "default"}, {Name: "app", Password: "p"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if users.initial() == nil || users.authenticate("app", "x") != nil || users.authenticate("app", "p") == nil {
+		t.Fatal("authenticate")
+	}
+
+	if _, err := NewUsers([]config.User{{Name: "x", Categories: []string{"nope"}}}); err == nil {
+		t.Fatal("unknown category accepted")
+	}
+}
+
+func TestUserAuthorize(t *testing.T) {
+
+	users, err := NewUsers([]config.User{
+		{Name: "ro", Password: "p", ReadOnly: true},
+		{Name: "app", Password: "p", Keys: []string{"app:*"}},
+		{Name: "reader", Password: "p", Categories: []string{"@read"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user    string
+		args    []string
+		allowed bool
+	}{
+		{"ro", []string{"GET", "a"}, true},
+		{"ro", []string{"SET", "a", "v"}, false},
+		{"ro", []string{"EVAL", "redis.call('flushall')", "0"}, false},
+		{"ro", []string{"EVAL_RO", "return 1", "0"}, true},
+		{"ro", []string{"SCRIPT", "FLUSH"}, false},
+		{"ro", []string{"FUNCTION", "DELETE", "lib"}, false},
+		{"ro", []string{"CONFIG", "SET", "maxmemory", "1"}, false},
+		{"ro", []string{"SHUTDOWN"}, false},
+		{"ro", []string{"REPLICAOF", "NO", "ONE"}, false},
+		{"ro", []string{"ACL", "SETUSER", "u", "on"}, false},
+		{"ro", []string{"DEBUG", "SLEEP", "1"}, false},
+		{"ro", []string{"CLIENT", "KILL", "ID", "1"}, false},
+		{"app", []string{"GET", "app:1"}, true},
+		{"app", []string{"GET", "other"}, false},
+		{"app", []string{"EVAL", "return 1", "1", "app:1"}, false},
+		{"app", []string{"EVALSHA_RO", "abc", "1", "app:1"}, false},
+		{"app", []string{"FLUSHALL"}, false},
+		{"app", []string{"FLUSHDB", "ASYNC"}, false},
+		{"app", []string{"SWAPDB", "0", "1"}, false},
+		{"app", []string{"KEYS", "*"}, false},
+		{"app", []string{"SCAN", "0"}, false},
+		{"app", []string{"RANDOMKEY"}, false},
+		{"app", []string{"SORT", "app:l", "BY", "x"}, false},
+		{"app", []string{"SORT_RO", "app:l", "GET", "other:*"}, false},
+		{"app", []string{"SORT", "app:l", "LIMIT", "0", "10", "ALPHA"}, true},
+		{"app", []string{"SORT", "app:l", "STORE", "app:by"}, true},
+		{"reader", []string{"GET", "a"}, true},
+		{"reader", []string{"FLUSHALL"}, false},
+	}
+
+	for _, test := range tests {
+
+		err := users.authenticate(test.user, "p").authorize(newTestRequest(test.args...))
+
+		if (err == nil) != test.allowed {
+			t.Errorf("%s %v: got %v, allowed %v", test.user, test.args, err, test.allowed)
+		}
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+
+	users, _ := NewUsers([]config.User{{Name: "u", Password: "p"}})
+	c := &CommandSession{manager: &Manager{users: users}}
+
+	req, err := c.helloAuth(&request{args: []string{"HELLO", "3", "AUTH", "u", "p", "SETNAME", "n"}, name: "hello"})
+
+	if err != nil || c.user == nil || string(req.raw) != string(formatCommand([]string{"HELLO", "3", "SETNAME", "n"})) {
+		t.Fatalf("%v %v", req, err)
+	}
+
+	c.user = nil
+
+	if _, err := c.helloAuth(&request{args: []string{"HELLO", "3"}, name: "hello"}); err == nil {
+		t.Fatal("HELLO without AUTH accepted")
+	}
+}